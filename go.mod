@@ -3,6 +3,7 @@ module github.com/cjey/gbase
 go 1.14
 
 require (
+	github.com/armon/go-metrics v0.0.0-20180917152333-f0300d1749da
 	github.com/google/uuid v1.1.1
 	github.com/hashicorp/memberlist v0.2.2
 	go.uber.org/zap v1.15.0
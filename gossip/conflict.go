@@ -0,0 +1,122 @@
+package gossip
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/hashicorp/memberlist"
+
+	"github.com/cjey/gbase"
+)
+
+// ConflictPolicy decide what to do when two nodes claim the same name
+type ConflictPolicy int
+
+const (
+	// ConflictReport only reports the conflict by log and MemberConflict event,
+	// the cluster keeps the node known first and ignores the other
+	ConflictReport ConflictPolicy = iota
+	// ConflictRename make the newer node re-register under a derived unique name,
+	// the node started later renames (the larger address if started at the same time), so both sides agree on it,
+	// the name is suffixed by a fragment derived from BootID and advertise address.
+	// The derived name is kept until the server is stopped, Config.Name is never changed
+	ConflictRename
+)
+
+// sharedTransport 重建memberlist时保留用户提供的transport，真正的关闭在Server.Shutdown中进行，Stop之后还可以重新启动
+type sharedTransport struct {
+	memberlist.Transport
+}
+
+func (t *sharedTransport) Shutdown() error {
+	return nil
+}
+
+func (s *Server) keepTransport() {
+	if t := s.Config.Transport; t != nil {
+		if _, ok := t.(*sharedTransport); !ok {
+			s.Config.Transport = &sharedTransport{t}
+		}
+	}
+}
+
+// derivedName 根据BootID和通告地址派生唯一的名字，同进程内的多个server也不会相同
+func (s *Server) derivedName(name string) string {
+	var h = fnv.New32a()
+	h.Write([]byte(gbase.BootID))
+	h.Write([]byte(s.Config.AdvertiseAddr + ":" + strconv.Itoa(s.Config.AdvertisePort)))
+	return fmt.Sprintf("%s-%08x", name, h.Sum32())
+}
+
+func (s *Server) conflict(existing, other *Node) {
+	s.ctx.Warn("Node name conflict", "name", existing.Name, "existing", existing.Address(), "other", other.Address())
+	s.count(&s.stats.conflicts, "gossip.conflict", 1)
+	s.events.publishEvent(MemberEvent{Type: MemberConflict, Node: existing, Other: other})
+
+	if s.ConflictPolicy != ConflictRename || existing.Name != s.localName() {
+		return
+	}
+	// 名字属于本节点时，existing就是本节点，双方都会收到冲突通知，
+	// 由后启动的节点重命名，双方的结论一致，避免同时重命名或者都不重命名
+	if !existing.newerThan(other) {
+		return
+	}
+	// 每次启动只重命名一次
+	if !atomic.CompareAndSwapInt32(&s.renamed, 0, 1) {
+		return
+	}
+	go s.rename(s.derivedName(existing.Name))
+}
+
+// newerThan 按照通告的启动时间比较，未通告启动时间的旧版本节点视为最早启动，相同时按照地址比较
+func (n *Node) newerThan(other *Node) bool {
+	if n.started != other.started {
+		return n.started > other.started
+	}
+	return n.Address() > other.Address()
+}
+
+// rename 以新的名字重建memberlist，旧的名字属于其他节点，所以不能广播leave
+func (s *Server) rename(name string) {
+	s.mu.Lock()
+	if s.State() != StateRunning {
+		s.mu.Unlock()
+		return
+	}
+
+	var old = s.localName()
+	var seeds = make([]string, 0)
+	for _, peer := range s.Others() {
+		seeds = append(seeds, peer.Address())
+	}
+	s.bmu.Lock()
+	for addr := range s.bootstraps {
+		seeds = append(seeds, addr)
+		s.bootstraps[addr] = false
+	}
+	s.bmu.Unlock()
+	if err := s.memberlist.Shutdown(); err != nil {
+		s.ctx.Warn("Shutdown memberlist for renaming failed", "err", err)
+	}
+	s.pmu.Lock()
+	s.peers = make(map[string]*Node)
+	s.pmu.Unlock()
+
+	s.setName(name)
+	var ml, err = s.createMemberlist()
+	if err != nil {
+		s.ctx.Warn("Re-register under new name failed, stopped", "name", name, "err", err)
+		s.finish()
+		s.mu.Unlock()
+		return
+	}
+	s.setMemberlist(ml)
+	s.mu.Unlock()
+
+	s.ctx.Info("Node renamed for name conflict", "from", old, "to", name)
+	if len(seeds) > 0 {
+		ml.Join(seeds)
+	}
+}
@@ -0,0 +1,319 @@
+package gossip
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Vivaldi算法的参数，与serf的默认值保持一致
+const (
+	_COORD_DIMENSION   = 8
+	_COORD_ERROR_MAX   = 1.5
+	_COORD_CE          = 0.25
+	_COORD_CC          = 0.25
+	_COORD_ADJUST_SIZE = 20
+	_COORD_HEIGHT_MIN  = 10.0e-6
+	_COORD_FILTER_SIZE = 3
+	_COORD_GRAVITY_RHO = 150.0
+	_COORD_ZERO        = 1.0e-6
+)
+
+// coordVersion ping payload的格式版本
+// payload格式：version(1) | float64(vec)*dimension | float64(error) | float64(adjustment) | float64(height) | 用户的ping payload
+const coordVersion = 1
+
+// Coordinate is the Vivaldi network coordinate of node,
+// the distance between two coordinates is the estimated rtt
+type Coordinate struct {
+	Vec        []float64
+	Error      float64
+	Adjustment float64
+	Height     float64
+}
+
+func newCoordinate() *Coordinate {
+	return &Coordinate{
+		Vec:    make([]float64, _COORD_DIMENSION),
+		Error:  _COORD_ERROR_MAX,
+		Height: _COORD_HEIGHT_MIN,
+	}
+}
+
+// Clone return a copy of coordinate
+func (c *Coordinate) Clone() *Coordinate {
+	var vec = make([]float64, len(c.Vec))
+	copy(vec, c.Vec)
+	return &Coordinate{
+		Vec:        vec,
+		Error:      c.Error,
+		Adjustment: c.Adjustment,
+		Height:     c.Height,
+	}
+}
+
+// DistanceTo return the estimated rtt between two coordinates
+func (c *Coordinate) DistanceTo(o *Coordinate) time.Duration {
+	var dist = c.rawDistanceTo(o)
+	if adjusted := dist + c.Adjustment + o.Adjustment; adjusted > 0 {
+		dist = adjusted
+	}
+	return time.Duration(dist * float64(time.Second))
+}
+
+func (c *Coordinate) rawDistanceTo(o *Coordinate) float64 {
+	return magnitude(diff(c.Vec, o.Vec)) + c.Height + o.Height
+}
+
+func (c *Coordinate) valid() bool {
+	if len(c.Vec) != _COORD_DIMENSION {
+		return false
+	}
+	for _, v := range c.Vec {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	for _, v := range []float64{c.Error, c.Adjustment, c.Height} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyForce 沿着o指向c的方向施加force，返回新的坐标
+func (c *Coordinate) applyForce(force float64, o *Coordinate) *Coordinate {
+	var ret = c.Clone()
+	var unit, mag = unitVectorAt(c.Vec, o.Vec)
+	for i := range ret.Vec {
+		ret.Vec[i] += unit[i] * force
+	}
+	if mag > _COORD_ZERO {
+		ret.Height = (ret.Height+o.Height)*force/mag + ret.Height
+		ret.Height = math.Max(ret.Height, _COORD_HEIGHT_MIN)
+	}
+	return ret
+}
+
+func diff(a, b []float64) []float64 {
+	var ret = make([]float64, len(a))
+	for i := range ret {
+		ret[i] = a[i] - b[i]
+	}
+	return ret
+}
+
+func magnitude(v []float64) float64 {
+	var sum float64
+	for _, x := range v {
+		sum += x * x
+	}
+	return math.Sqrt(sum)
+}
+
+// unitVectorAt 返回从b指向a的单位向量，两点重合时随机选择一个方向
+func unitVectorAt(a, b []float64) ([]float64, float64) {
+	var ret = diff(a, b)
+	if mag := magnitude(ret); mag > _COORD_ZERO {
+		for i := range ret {
+			ret[i] /= mag
+		}
+		return ret, mag
+	}
+	for i := range ret {
+		ret[i] = rand.Float64() - 0.5
+	}
+	if mag := magnitude(ret); mag > _COORD_ZERO {
+		for i := range ret {
+			ret[i] /= mag
+		}
+		return ret, 0
+	}
+	ret = make([]float64, len(ret))
+	ret[0] = 1
+	return ret, 0
+}
+
+func encodePingPayload(c *Coordinate, payload []byte) []byte {
+	var buf = make([]byte, 1+8*(len(c.Vec)+3), 1+8*(len(c.Vec)+3)+len(payload))
+	buf[0] = coordVersion
+	var off = 1
+	for _, v := range append(c.Vec[:len(c.Vec):len(c.Vec)], c.Error, c.Adjustment, c.Height) {
+		binary.BigEndian.PutUint64(buf[off:], math.Float64bits(v))
+		off += 8
+	}
+	return append(buf, payload...)
+}
+
+// decodePingPayload 解析ping payload，版本不符或者长度不足时整体视为用户的原始数据，
+// 格式正确但坐标无效(NaN或者Inf)时只丢弃坐标，其后的用户数据照常返回
+func decodePingPayload(buf []byte) (*Coordinate, []byte) {
+	var size = 1 + 8*(_COORD_DIMENSION+3)
+	if len(buf) < size || buf[0] != coordVersion {
+		return nil, buf
+	}
+	var fs = make([]float64, _COORD_DIMENSION+3)
+	for i := range fs {
+		fs[i] = math.Float64frombits(binary.BigEndian.Uint64(buf[1+8*i:]))
+	}
+	var c = &Coordinate{
+		Vec:        fs[:_COORD_DIMENSION],
+		Error:      fs[_COORD_DIMENSION],
+		Adjustment: fs[_COORD_DIMENSION+1],
+		Height:     fs[_COORD_DIMENSION+2],
+	}
+	if !c.valid() {
+		return nil, buf[size:]
+	}
+	return c, buf[size:]
+}
+
+// vivaldi 维护本节点的坐标，以及通过ping获得的其他节点的坐标
+type vivaldi struct {
+	mu      sync.RWMutex
+	local   *Coordinate
+	origin  *Coordinate
+	samples []float64
+	index   int
+	// key<node name> => value<最近几次的rtt样本，用于取中位数过滤抖动>
+	latency map[string][]float64
+	// key<node name> => value<coordinate>
+	coords map[string]*Coordinate
+}
+
+func newVivaldi() *vivaldi {
+	return &vivaldi{
+		local:   newCoordinate(),
+		origin:  newCoordinate(),
+		samples: make([]float64, _COORD_ADJUST_SIZE),
+		latency: make(map[string][]float64),
+		coords:  make(map[string]*Coordinate),
+	}
+}
+
+func (v *vivaldi) coordinate() *Coordinate {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.local.Clone()
+}
+
+func (v *vivaldi) get(name string) *Coordinate {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.coords[name]
+}
+
+func (v *vivaldi) forget(name string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.coords, name)
+	delete(v.latency, name)
+}
+
+// filter 返回最近几次rtt的中位数
+func (v *vivaldi) filter(name string, rtt float64) float64 {
+	var samples = append(v.latency[name], rtt)
+	if len(samples) > _COORD_FILTER_SIZE {
+		samples = samples[1:]
+	}
+	v.latency[name] = samples
+	var sorted = make([]float64, len(samples))
+	copy(sorted, samples)
+	sort.Float64s(sorted)
+	return sorted[len(sorted)/2]
+}
+
+// update 根据到其他节点的实测rtt调整本节点的坐标
+func (v *vivaldi) update(name string, other *Coordinate, rtt time.Duration) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.coords[name] = other
+
+	var seconds = math.Max(v.filter(name, rtt.Seconds()), _COORD_ZERO)
+
+	// vivaldi
+	var dist = v.local.DistanceTo(other).Seconds()
+	var wrongness = math.Abs(dist-seconds) / seconds
+	var weight = v.local.Error / math.Max(v.local.Error+other.Error, _COORD_ZERO)
+	var local = v.local.Clone()
+	local.Error = math.Min(_COORD_CE*weight*wrongness+local.Error*(1-_COORD_CE*weight), _COORD_ERROR_MAX)
+	local = local.applyForce(_COORD_CC*weight*(seconds-dist), other)
+
+	// adjustment，修正欧式空间无法表达的偏差
+	v.samples[v.index] = seconds - local.rawDistanceTo(other)
+	v.index = (v.index + 1) % len(v.samples)
+	var sum float64
+	for _, s := range v.samples {
+		sum += s
+	}
+	local.Adjustment = sum / (2 * float64(len(v.samples)))
+
+	// gravity，避免坐标整体漂移
+	var force = -math.Pow(v.origin.DistanceTo(local).Seconds()/_COORD_GRAVITY_RHO, 2)
+	local = local.applyForce(force, v.origin)
+
+	if !local.valid() {
+		local = newCoordinate()
+	}
+	v.local = local
+}
+
+// Coordinate return the network coordinate of local node
+func (s *Server) Coordinate() *Coordinate {
+	return s.coords.coordinate()
+}
+
+// CoordinateOf return the network coordinate of the node, nil if unknown yet
+func (s *Server) CoordinateOf(name string) *Coordinate {
+	if name == s.localName() {
+		return s.coords.coordinate()
+	}
+	if c := s.coords.get(name); c != nil {
+		return c.Clone()
+	}
+	return nil
+}
+
+// EstimateRTT return the estimated rtt between any two nodes by their network coordinates,
+// false if the coordinate of any node is unknown
+func (s *Server) EstimateRTT(a, b string) (time.Duration, bool) {
+	var ca, cb = s.CoordinateOf(a), s.CoordinateOf(b)
+	if ca == nil || cb == nil {
+		return 0, false
+	}
+	return ca.DistanceTo(cb), true
+}
+
+// NearestTo return at most k (all if k <= 0) nodes nearest to the given node matching all filters,
+// ordered by estimated rtt, the given node and the nodes whose coordinate is unknown are excluded
+func (s *Server) NearestTo(name string, k int, filters ...PeerFilter) []*Node {
+	var target = s.CoordinateOf(name)
+	if target == nil {
+		return nil
+	}
+	type candidate struct {
+		node *Node
+		rtt  time.Duration
+	}
+	var candidates = make([]candidate, 0)
+	for _, n := range s.Select(append(filters[:len(filters):len(filters)], WithoutNames(name))...) {
+		if c := s.CoordinateOf(n.Name); c != nil {
+			candidates = append(candidates, candidate{n, target.DistanceTo(c)})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].rtt < candidates[j].rtt
+	})
+	if k > 0 && k < len(candidates) {
+		candidates = candidates[:k]
+	}
+	var nodes = make([]*Node, len(candidates))
+	for i, c := range candidates {
+		nodes[i] = c.node
+	}
+	return nodes
+}
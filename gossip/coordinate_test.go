@@ -0,0 +1,81 @@
+package gossip
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCoordinatePayload(t *testing.T) {
+	var c = newCoordinate()
+	c.Vec[0], c.Adjustment = 0.01, -0.001
+	var got, payload = decodePingPayload(encodePingPayload(c, []byte("user")))
+	if got == nil || got.Vec[0] != 0.01 || got.Adjustment != -0.001 || string(payload) != "user" {
+		t.Errorf("unexpected decoded %v %q", got, payload)
+	}
+
+	// legacy payload without coordinate
+	if got, payload = decodePingPayload([]byte("legacy")); got != nil || string(payload) != "legacy" {
+		t.Errorf("legacy payload should be kept, got %v %q", got, payload)
+	}
+
+	// invalid coordinate is dropped, the user payload is kept
+	c.Height = math.Inf(1)
+	if got, payload = decodePingPayload(encodePingPayload(c, []byte("user"))); got != nil || string(payload) != "user" {
+		t.Errorf("invalid coordinate should be dropped, got %v %q", got, payload)
+	}
+}
+
+func TestCoordinateConverge(t *testing.T) {
+	// 4个节点位于一条直线上，相邻间隔10ms
+	const n = 4
+	var nodes = make([]*vivaldi, n)
+	for i := range nodes {
+		nodes[i] = newVivaldi()
+	}
+	var truth = func(i, j int) time.Duration {
+		return time.Duration(math.Abs(float64(i-j))) * 10 * time.Millisecond
+	}
+	for round := 0; round < 200; round++ {
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				if i != j {
+					nodes[i].update(string(rune('a'+j)), nodes[j].coordinate(), truth(i, j))
+				}
+			}
+		}
+	}
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			var est = nodes[i].coordinate().DistanceTo(nodes[j].coordinate())
+			if d := est - truth(i, j); d > 3*time.Millisecond || d < -3*time.Millisecond {
+				t.Errorf("estimated rtt between %d and %d is %v, expect %v", i, j, est, truth(i, j))
+			}
+		}
+	}
+}
+
+func TestNearestTo(t *testing.T) {
+	var s = NewServer("self", "")
+	s.name = "self"
+	for i, name := range []string{"self", "a", "b", "c"} {
+		addTestPeer(s, name, nil, -1)
+		if name != "self" {
+			var c = newCoordinate()
+			c.Vec[0] = float64(i) * 0.01
+			s.coords.coords[name] = c
+		}
+	}
+	addTestPeer(s, "unknown", nil, -1)
+
+	var nodes = s.NearestTo("c", 2)
+	if len(nodes) != 2 || nodes[0].Name != "b" || nodes[1].Name != "a" {
+		t.Errorf("unexpected nearest nodes %v", nodes)
+	}
+	if rtt, ok := s.EstimateRTT("a", "c"); !ok || rtt < 19*time.Millisecond || rtt > 21*time.Millisecond {
+		t.Errorf("unexpected estimated rtt %v", rtt)
+	}
+	if _, ok := s.EstimateRTT("a", "unknown"); ok {
+		t.Error("rtt to unknown coordinate should not be estimated")
+	}
+}
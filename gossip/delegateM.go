@@ -32,30 +32,53 @@ func (d *delegateM) start() {
 // 本Node的有限大小元数据(默认512字节)，在广播alive时会提供给接收节点
 // 本方法在节点刚启动时，以及主动调用server的UpdateNode方法时才被调用到
 // 即server假定metadata不会改变，如果发生了改变，必须主动调用UpdateNode方法来触发一次cluster范围的metadata更新
+// 元数据由segment标识、tags和用户的原始数据组成，用户数据的可用空间需扣除前两者的部分
 func (d *delegateM) NodeMeta(limit int) []byte {
-	if d.dg == nil {
-		return nil
+	var m = d.srv.localMeta()
+	if d.dg != nil {
+		m.meta = d.dg.Metadata(limit - len(encodeMeta(m)))
 	}
-	return d.dg.Metadata(limit)
+	return encodeMeta(m)
 }
 
 // 当有用户数据过来时，会调用本方法
 // msg如果要保存，必须做copy
 // 数据可以是广播数据，也可以是某节点直接单播过来的数据
 func (d *delegateM) NotifyMsg(msg []byte) {
-	if d.dg == nil {
+	// 处理消息时可能需要回复，必须等待memberlist创建完成
+	if !d.srv.waitReady() {
 		return
 	}
-
-	d.dg.NotifyMessage(msg)
+	d.srv.countReceived(msg)
+	var kind, body = decodeMessage(msg)
+	switch kind {
+	case kindUser:
+		if d.dg != nil {
+			d.dg.NotifyMessage(body)
+		}
+	case kindKV:
+		d.srv.kv.notifyMessage(body)
+	case kindTopic:
+		d.srv.topics.dispatch(body)
+	case kindRPC:
+		d.srv.rpc.notifyMessage(body)
+	case kindKeyed:
+		d.notifyKeyedMessage(body)
+	case kindEvent:
+		d.srv.uevents.notifyMessage(body)
+	case kindQuery:
+		d.srv.queries.notifyMessage(body)
+	case kindFailure:
+		d.srv.notifyFailure(body)
+	case kindStream:
+		d.srv.streams.notifyMessage(body)
+	}
 }
 
 // 获取可广播的用户数据，server通过此方法获得和传播增量状态
 // 数据总长不得超过limit，并且，每个slice必须开头预留overhead个字节
+// KV、topic和用户事件等内置功能也通过sender广播，所以即使没有注册Delegate也要取出
 func (d *delegateM) GetBroadcasts(overhead, limit int) [][]byte {
-	if d.dg == nil {
-		return nil
-	}
 	return d.sender.getBroadcasts(overhead, limit)
 }
 
@@ -63,9 +86,9 @@ func (d *delegateM) GetBroadcasts(overhead, limit int) [][]byte {
 // 新节点加入时，或者定期的pullpush发生后，此方法会被调用一次
 // 本节点应当通过此方法返回自身的完整状态信息给到发起pullpush的节点
 // 虽然可以快速收敛，但成本较高
-// 一般不用，不予实现
+// 用于KV的反熵同步，以及交换用户事件的lamport时间
 func (d *delegateM) LocalState(join bool) []byte {
-	return nil
+	return encodeState(d.srv.uevents.clock.time(), d.srv.kv.localState())
 }
 
 // 合并peer的状态数据，用于合并其他peer的状态数据
@@ -73,8 +96,13 @@ func (d *delegateM) LocalState(join bool) []byte {
 // server会将从其他节点获得的完整状态数据传递给此方法
 // 此方法应当将得到的状态数据合并到自身的状态中
 // 与LocalState配合使用
-// 一般不用，不予实现
 func (d *delegateM) MergeRemoteState(buf []byte, join bool) {
+	var ltime, kv, err = decodeState(buf)
+	if err != nil {
+		return
+	}
+	d.srv.uevents.clock.witness(ltime)
+	d.srv.kv.mergeRemoteState(kv)
 }
 
 // <EventDelegate>，节点的事件通知
@@ -83,12 +111,18 @@ func (d *delegateM) MergeRemoteState(buf []byte, join bool) {
 // 随后，有新节点加入时才会触发一次
 func (d *delegateM) NotifyJoin(peer *memberlist.Node) {
 	var node = newNode(peer)
+	d.srv.suspecters.joined(node.Name, time.Now())
 	d.srv.nodeOnline(node)
+	d.srv.events.publish(MemberJoin, node)
 	if d.dg == nil {
 		return
 	}
 	d.dg.NotifyJoin(node)
-	go d.sender.Ping(node.Name)
+	go func() {
+		if d.srv.waitReady() {
+			d.sender.Ping(node.Name)
+		}
+	}()
 }
 
 // 有Node离开时会触发一次此方法
@@ -98,7 +132,17 @@ func (d *delegateM) NotifyLeave(peer *memberlist.Node) {
 	if node == nil {
 		return
 	}
+	// memberlist v0.2.2的Node.State总是alive，只能依赖离开前的通知来区分离开和死亡
+	if d.srv.suspecters.takeLeft(node.Name) || peer.State == memberlist.StateLeft {
+		d.srv.suspecters.take(node.Name)
+	} else {
+		d.srv.nodeDead(node)
+	}
 	d.srv.nodeOffline(node)
+	d.srv.suspecters.forget(node.Name)
+	d.srv.keyed.forget(node.Name)
+	d.srv.coords.forget(node.Name)
+	d.srv.events.publish(MemberLeave, node)
 	if d.dg == nil {
 		return
 	}
@@ -115,6 +159,7 @@ func (d *delegateM) NotifyUpdate(peer *memberlist.Node) {
 	var newNode = newNode(peer)
 	newNode.RTT = rtt
 	d.srv.nodeUpdate(newNode)
+	d.srv.events.publish(MemberUpdate, newNode)
 	if d.dg == nil {
 		return
 	}
@@ -128,11 +173,13 @@ func (d *delegateM) NotifyUpdate(peer *memberlist.Node) {
 // 2. ping会触发双向互ping，可用于某些关键控制数据的交换
 
 // 主动发起方拿出自己的AckPayload，向目标发出一个ping消息
+// payload中总是携带本节点的网络坐标，用户的payload附在其后
 func (d *delegateM) AckPayload() []byte {
-	if d.dg == nil {
-		return nil
+	var payload []byte
+	if d.dg != nil {
+		payload = d.dg.PingPayload()
 	}
-	return d.dg.PingPayload()
+	return encodePingPayload(d.srv.coords.coordinate(), payload)
 }
 
 // 被动方收到主动方推送过来的payload
@@ -143,10 +190,17 @@ func (d *delegateM) NotifyPingComplete(peer *memberlist.Node, rtt time.Duration,
 		return
 	}
 	d.srv.nodePing(node, rtt)
+	d.srv.count(&d.srv.stats.probes, "gossip.probe", 1)
+	d.srv.sample("gossip.probe.rtt", float64(rtt)/float64(time.Millisecond))
+	var coord, data = decodePingPayload(payload)
+	if coord != nil {
+		d.srv.coords.update(node.Name, coord, rtt)
+	}
+	d.srv.events.publish(MemberPing, node)
 	if d.dg == nil {
 		return
 	}
-	d.dg.NotifyPing(node, payload)
+	d.dg.NotifyPing(node, data)
 }
 
 // <AliveDelegate>
@@ -155,10 +209,9 @@ func (d *delegateM) NotifyPingComplete(peer *memberlist.Node, rtt time.Duration,
 // 一般而言，可以不用关注alive广播，只通过Join和Leave事件来关注节点的情况即可
 
 // 返回值非nil，则表示直接忽略该节点的alive广播，也等于是禁止该节点加入本server
-// 特别的用法上(一般不用)，可以通过此机制，来在一个广播域中划分子域(类似同一个交换机下，跑多个网段)
-// 一般不用，不予实现
+// 通过此机制，按照Segment在一个广播域中划分子域(类似同一个交换机下，跑多个网段)
 func (d *delegateM) NotifyAlive(peer *memberlist.Node) error {
-	return nil
+	return d.srv.admit(peer)
 }
 
 // <MergeDelegate>
@@ -167,8 +220,13 @@ func (d *delegateM) NotifyAlive(peer *memberlist.Node) error {
 // 如果返回值非nil，则表示不同意合并这些节点的信息，这样也不会触发后续的MergeRemoteState方法
 // 只有在节点join前会调用一次，同意或者拒绝之后，将不再调用
 // 注意，即使返回值非nil，也不表示该节点不在集群中，仅仅表示不接受该节点的full state交换
-// 一般不用，不予实现
+// 只要其中有任一节点不属于本Segment，则拒绝整个合并，避免两个集群互相污染
 func (d *delegateM) NotifyMerge(peers []*memberlist.Node) error {
+	for _, peer := range peers {
+		if err := d.srv.admit(peer); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -179,6 +237,7 @@ func (d *delegateM) NotifyMerge(peers []*memberlist.Node) error {
 // 而第三方节点在新冲突节点full state时，触发一次alive，并触发一次conflict，并且以本地已有的node为准
 // 而当旧节点leave后，第三方节点经过几个周期的conflict后，将接纳新节点占用此Name
 // 如果网络中已经存在Name冲突，新加入的节点只会认可先join到自己的那个
-// 一般不用，不予实现
+// 冲突总是会被记录并通知订阅者，按照ConflictPolicy，后启动的节点重命名后重新加入
 func (d *delegateM) NotifyConflict(existing, other *memberlist.Node) {
+	d.srv.conflict(newNode(existing), newNode(other))
 }
@@ -0,0 +1,222 @@
+package gossip
+
+// DelegateFuncs implement Delegate by optional function fields,
+// nil field means doing nothing
+type DelegateFuncs struct {
+	GossipStartedFunc func(*Sender)
+	MetadataFunc      func(limit int) []byte
+	NotifyJoinFunc    func(*Node)
+	NotifyLeaveFunc   func(*Node)
+	NotifyUpdateFunc  func(*Node)
+	PingPayloadFunc   func() []byte
+	NotifyPingFunc    func(other *Node, payload []byte)
+	NotifyMessageFunc func(msg []byte)
+}
+
+var _ Delegate = &DelegateFuncs{}
+
+func (d *DelegateFuncs) GossipStarted(s *Sender) {
+	if d.GossipStartedFunc != nil {
+		d.GossipStartedFunc(s)
+	}
+}
+
+func (d *DelegateFuncs) Metadata(limit int) []byte {
+	if d.MetadataFunc != nil {
+		return d.MetadataFunc(limit)
+	}
+	return nil
+}
+
+func (d *DelegateFuncs) NotifyJoin(n *Node) {
+	if d.NotifyJoinFunc != nil {
+		d.NotifyJoinFunc(n)
+	}
+}
+
+func (d *DelegateFuncs) NotifyLeave(n *Node) {
+	if d.NotifyLeaveFunc != nil {
+		d.NotifyLeaveFunc(n)
+	}
+}
+
+func (d *DelegateFuncs) NotifyUpdate(n *Node) {
+	if d.NotifyUpdateFunc != nil {
+		d.NotifyUpdateFunc(n)
+	}
+}
+
+func (d *DelegateFuncs) PingPayload() []byte {
+	if d.PingPayloadFunc != nil {
+		return d.PingPayloadFunc()
+	}
+	return nil
+}
+
+func (d *DelegateFuncs) NotifyPing(other *Node, payload []byte) {
+	if d.NotifyPingFunc != nil {
+		d.NotifyPingFunc(other, payload)
+	}
+}
+
+func (d *DelegateFuncs) NotifyMessage(msg []byte) {
+	if d.NotifyMessageFunc != nil {
+		d.NotifyMessageFunc(msg)
+	}
+}
+
+// MultiDelegate fan out all callbacks to several delegates in order.
+// Metadata and PingPayload of every delegate are packed into separated segments,
+// and every delegate only sees it's own segment in Node.Meta and NotifyPing,
+// so all nodes in the cluster must compose the delegates in the same order.
+type MultiDelegate struct {
+	delegates []Delegate
+}
+
+var _ Delegate = &MultiDelegate{}
+var _ KeyedMessageDelegate = &MultiDelegate{}
+var _ FailureDelegate = &MultiDelegate{}
+
+// NewMultiDelegate return a delegate composed by the given delegates
+func NewMultiDelegate(delegates ...Delegate) *MultiDelegate {
+	return &MultiDelegate{delegates: delegates}
+}
+
+// _MAX_PING_PAYLOAD 合并后的ping payload的大小限制，需保证ack能放进一个udp包
+const _MAX_PING_PAYLOAD = 1024
+
+func uvarintSize(v uint64) int {
+	return len(appendUvarint(nil, v))
+}
+
+// 分段格式：uvarint(count) | (uvarint(len(segment)) | segment)*
+func packSegments(limit int, n int, get func(i, limit int) []byte) []byte {
+	var buf = appendUvarint(nil, uint64(n))
+	for i := 0; i < n; i++ {
+		// 为后续每段预留至少1字节的长度前缀
+		var remain = limit - len(buf) - (n - i - 1)
+		var seg []byte
+		if room := remain - uvarintSize(uint64(remain)); room > 0 {
+			seg = get(i, room)
+		}
+		if uvarintSize(uint64(len(seg)))+len(seg) > remain {
+			// 超出限制的段被丢弃
+			seg = nil
+		}
+		buf = appendUvarint(buf, uint64(len(seg)))
+		buf = append(buf, seg...)
+	}
+	return buf
+}
+
+func unpackSegments(buf []byte, n int) [][]byte {
+	var segs = make([][]byte, n)
+	var count, rest, err = readUvarint(buf)
+	if err != nil || count != uint64(n) {
+		return segs
+	}
+	for i := 0; i < n; i++ {
+		var l uint64
+		if l, rest, err = readUvarint(rest); err != nil || l > uint64(len(rest)) {
+			return make([][]byte, n)
+		}
+		if l > 0 {
+			segs[i] = rest[:l]
+		}
+		rest = rest[l:]
+	}
+	return segs
+}
+
+// nodeFor 返回只包含第i个delegate元数据的节点副本
+func (m *MultiDelegate) nodeFor(n *Node, segs [][]byte, i int) *Node {
+	var c = *n
+	c.Meta = segs[i]
+	return &c
+}
+
+func (m *MultiDelegate) GossipStarted(s *Sender) {
+	for _, d := range m.delegates {
+		d.GossipStarted(s)
+	}
+}
+
+func (m *MultiDelegate) Metadata(limit int) []byte {
+	return packSegments(limit, len(m.delegates), func(i, limit int) []byte {
+		return m.delegates[i].Metadata(limit)
+	})
+}
+
+func (m *MultiDelegate) notifyNode(n *Node, f func(d Delegate, n *Node)) {
+	var segs = unpackSegments(n.Meta, len(m.delegates))
+	for i, d := range m.delegates {
+		f(d, m.nodeFor(n, segs, i))
+	}
+}
+
+func (m *MultiDelegate) NotifyJoin(n *Node) {
+	m.notifyNode(n, Delegate.NotifyJoin)
+}
+
+func (m *MultiDelegate) NotifyLeave(n *Node) {
+	m.notifyNode(n, Delegate.NotifyLeave)
+}
+
+func (m *MultiDelegate) NotifyUpdate(n *Node) {
+	m.notifyNode(n, Delegate.NotifyUpdate)
+}
+
+// PingPayload 没有明确的大小限制，按照udp包的常规大小处理
+func (m *MultiDelegate) PingPayload() []byte {
+	return packSegments(_MAX_PING_PAYLOAD, len(m.delegates), func(i, limit int) []byte {
+		return m.delegates[i].PingPayload()
+	})
+}
+
+func (m *MultiDelegate) NotifyPing(other *Node, payload []byte) {
+	var metas = unpackSegments(other.Meta, len(m.delegates))
+	var segs = unpackSegments(payload, len(m.delegates))
+	for i, d := range m.delegates {
+		d.NotifyPing(m.nodeFor(other, metas, i), segs[i])
+	}
+}
+
+func (m *MultiDelegate) NotifyMessage(msg []byte) {
+	for _, d := range m.delegates {
+		d.NotifyMessage(msg)
+	}
+}
+
+func (m *MultiDelegate) NotifyKeyedMessage(from, key string, version uint64, msg []byte) {
+	for _, d := range m.delegates {
+		if kd, ok := d.(KeyedMessageDelegate); ok {
+			kd.NotifyKeyedMessage(from, key, version, msg)
+		} else {
+			d.NotifyMessage(msg)
+		}
+	}
+}
+
+func (m *MultiDelegate) NotifySuspect(node *Node, from string) {
+	for _, d := range m.delegates {
+		if fd, ok := d.(FailureDelegate); ok {
+			fd.NotifySuspect(node, from)
+		}
+	}
+}
+
+func (m *MultiDelegate) NotifyRefute(node *Node, from string) {
+	for _, d := range m.delegates {
+		if fd, ok := d.(FailureDelegate); ok {
+			fd.NotifyRefute(node, from)
+		}
+	}
+}
+
+func (m *MultiDelegate) NotifyDead(node *Node, from string) {
+	for _, d := range m.delegates {
+		if fd, ok := d.(FailureDelegate); ok {
+			fd.NotifyDead(node, from)
+		}
+	}
+}
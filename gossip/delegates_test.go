@@ -0,0 +1,71 @@
+package gossip
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestMultiDelegate(t *testing.T) {
+	var metas [2][]byte
+	var messages int
+	var a = &DelegateFuncs{
+		MetadataFunc: func(limit int) []byte { return []byte("meta-a") },
+		NotifyJoinFunc: func(n *Node) {
+			metas[0] = n.Meta
+		},
+		NotifyMessageFunc: func(msg []byte) { messages++ },
+	}
+	var b = &DelegateFuncs{
+		MetadataFunc: func(limit int) []byte { return bytes.Repeat([]byte("b"), limit) },
+		NotifyJoinFunc: func(n *Node) {
+			metas[1] = n.Meta
+		},
+		NotifyMessageFunc: func(msg []byte) { messages++ },
+	}
+	var m = NewMultiDelegate(a, b, &DelegateFuncs{})
+
+	var meta = m.Metadata(64)
+	if len(meta) > 64 {
+		t.Fatalf("metadata exceeds limit, got %d bytes", len(meta))
+	}
+	m.NotifyJoin(&Node{Name: "x", Meta: meta})
+	if string(metas[0]) != "meta-a" {
+		t.Errorf("unexpected segment of a %q", metas[0])
+	}
+	if len(metas[1]) == 0 || len(metas[1]) > 64 {
+		t.Errorf("unexpected segment of b %q", metas[1])
+	}
+
+	m.NotifyMessage([]byte("hello"))
+	m.NotifyKeyedMessage("x", "k", 1, []byte("hello"))
+	if messages != 4 {
+		t.Errorf("messages should fan out to all delegates, got %d", messages)
+	}
+
+	// greedy delegate can not break the limit
+	var greedy = &DelegateFuncs{
+		MetadataFunc: func(limit int) []byte { return make([]byte, limit+10) },
+	}
+	if meta := NewMultiDelegate(a, greedy).Metadata(16); len(meta) > 16 {
+		t.Errorf("metadata exceeds limit, got %d bytes", len(meta))
+	}
+}
+
+func TestAddDelegateConcurrent(t *testing.T) {
+	var s = NewServer("a", "")
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.AddDelegate(&DelegateFuncs{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if m, ok := s.delegate.(*MultiDelegate); !ok || len(m.delegates) != 16 {
+		t.Errorf("every delegate should be kept, got %#v", s.delegate)
+	}
+}
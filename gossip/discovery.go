@@ -0,0 +1,241 @@
+package gossip
+
+import (
+	"bufio"
+	"bytes"
+	gcontext "context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cjey/gbase/context"
+)
+
+// DefaultDiscoveryInterval is the default interval of discovering seeds and rejoining offline seeds
+const DefaultDiscoveryInterval = 5 * time.Second
+
+// Discoverer discover the seed addresses (host:port) of cluster,
+// it's called periodically, so seeds can change at runtime
+type Discoverer interface {
+	Discover(ctx context.Context) ([]string, error)
+}
+
+// DiscoverFunc adapt a callback to Discoverer
+type DiscoverFunc func(ctx context.Context) ([]string, error)
+
+func (f DiscoverFunc) Discover(ctx context.Context) ([]string, error) {
+	return f(ctx)
+}
+
+// StaticSeeds is a fixed list of seed addresses
+type StaticSeeds []string
+
+func (s StaticSeeds) Discover(ctx context.Context) ([]string, error) {
+	return s, nil
+}
+
+// FileSeeds read seeds from a file, one address per line, blank lines and lines starting with # are ignored.
+// The file is reloaded only if it's modified.
+type FileSeeds struct {
+	Path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	seeds   []string
+}
+
+// NewFileSeeds return a discoverer reading seeds from the file
+func NewFileSeeds(path string) *FileSeeds {
+	return &FileSeeds{Path: path}
+}
+
+func (f *FileSeeds) Discover(ctx context.Context) ([]string, error) {
+	var info, err = os.Stat(f.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.seeds != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.seeds, nil
+	}
+	var content []byte
+	if content, err = ioutil.ReadFile(f.Path); err != nil {
+		return nil, err
+	}
+	var seeds = make([]string, 0)
+	var scanner = bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		var line = strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		seeds = append(seeds, line)
+	}
+	f.seeds, f.modTime, f.size = seeds, info.ModTime(), info.Size()
+	return seeds, nil
+}
+
+// Resolver is the subset of *net.Resolver used by DNSSeeds
+type Resolver interface {
+	LookupHost(ctx gcontext.Context, host string) ([]string, error)
+	LookupSRV(ctx gcontext.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSSeeds discover seeds by DNS records
+type DNSSeeds struct {
+	// Name is the domain name to lookup
+	Name string
+	// Port is used with A/AAAA records, ignored if SRV is true
+	Port int
+	// SRV lookup SRV records of Name directly, instead of A/AAAA records
+	SRV bool
+	// Resolver is net.DefaultResolver if nil
+	Resolver Resolver
+}
+
+func (d *DNSSeeds) resolver() Resolver {
+	if d.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return d.Resolver
+}
+
+func (d *DNSSeeds) Discover(ctx context.Context) ([]string, error) {
+	var seeds = make([]string, 0)
+	if d.SRV {
+		var _, srvs, err = d.resolver().LookupSRV(ctx, "", "", d.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			var target = strings.TrimSuffix(srv.Target, ".")
+			seeds = append(seeds, net.JoinHostPort(target, strconv.Itoa(int(srv.Port))))
+		}
+		return seeds, nil
+	}
+	if d.Port <= 0 {
+		return nil, fmt.Errorf("port of dns seeds %s is required", d.Name)
+	}
+	var hosts, err = d.resolver().LookupHost(ctx, d.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		seeds = append(seeds, net.JoinHostPort(host, strconv.Itoa(d.Port)))
+	}
+	return seeds, nil
+}
+
+// discoverSeeds 汇总所有discoverer的结果，去重并排除本节点的地址，单个失败不影响其他
+// 所有discoverer并发执行，共用一个TCPTimeout的期限，超时未返回的discoverer被忽略，启动不会被阻塞太久
+func (s *Server) discoverSeeds(bind string) []string {
+	var discoverers = []Discoverer{StaticSeeds(s.Bootstraps)}
+	if s.Discoverer != nil {
+		discoverers = append(discoverers, s.Discoverer)
+	}
+	if s.SnapshotPath != "" {
+		discoverers = append(discoverers, DiscoverFunc(s.snapshotSeeds))
+	}
+	type result struct {
+		addrs []string
+		err   error
+	}
+	var ctx, cancel = s.ctx.WithTimeout(s.Config.TCPTimeout)
+	defer cancel()
+	var results = make(chan result, len(discoverers))
+	for _, d := range discoverers {
+		go func(d Discoverer) {
+			var addrs, err = d.Discover(ctx)
+			results <- result{addrs, err}
+		}(d)
+	}
+
+	var uniq = make(map[string]bool)
+	var seeds = make([]string, 0)
+collect:
+	for i := 0; i < len(discoverers); i++ {
+		var r result
+		select {
+		case r = <-results:
+		case <-ctx.Done():
+			s.ctx.Warn("Discover seeds timeout", "pending", len(discoverers)-i)
+			break collect
+		}
+		if r.err != nil {
+			s.ctx.Warn("Discover seeds failed", "err", r.err)
+			continue
+		}
+		for _, a := range r.addrs {
+			var addr, err = net.ResolveTCPAddr("tcp", strings.TrimSpace(a))
+			if err != nil {
+				s.ctx.Warn("Invalid seed address", "addr", a, "err", err)
+				continue
+			}
+			if a = addr.String(); a != bind && !uniq[a] {
+				uniq[a] = true
+				seeds = append(seeds, a)
+			}
+		}
+	}
+	sort.Strings(seeds)
+	return seeds
+}
+
+// updateSeeds 同步最新的seeds，保留已知seed的在线状态，返回离线的seeds
+func (s *Server) updateSeeds(seeds []string) []string {
+	var known = make(map[string]bool)
+	for _, peer := range s.Peers() {
+		known[peer.Address()] = true
+	}
+
+	s.bmu.Lock()
+	defer s.bmu.Unlock()
+	var bootstraps = make(map[string]bool, len(seeds))
+	for _, addr := range seeds {
+		if online, ok := s.bootstraps[addr]; ok {
+			bootstraps[addr] = online
+		} else {
+			// 新发现的seed可能已经在集群中
+			bootstraps[addr] = known[addr]
+		}
+	}
+	s.bootstraps = bootstraps
+
+	var offlines = make([]string, 0)
+	for addr, online := range s.bootstraps {
+		if !online {
+			offlines = append(offlines, addr)
+		}
+	}
+	return offlines
+}
+
+// keepSeedsOnline 定期发现seeds，并尝试加入离线的seeds，启动时已经加入过一次，直到本次运行结束
+func (s *Server) keepSeedsOnline(bind string, shutsig chan struct{}) {
+	var interval = s.DiscoveryInterval
+	if interval <= 0 {
+		interval = DefaultDiscoveryInterval
+	}
+	for {
+		select {
+		case <-shutsig:
+			return
+		case <-time.After(interval):
+		}
+
+		if offlines := s.updateSeeds(s.discoverSeeds(bind)); len(offlines) > 0 {
+			if ml := s.currentMemberlist(); ml != nil {
+				ml.Join(offlines)
+			}
+		}
+	}
+}
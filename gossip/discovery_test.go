@@ -0,0 +1,126 @@
+package gossip
+
+import (
+	gcontext "context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cjey/gbase/context"
+)
+
+type stubResolver struct {
+	hosts map[string][]string
+	srvs  map[string][]*net.SRV
+}
+
+func (r *stubResolver) LookupHost(ctx gcontext.Context, host string) ([]string, error) {
+	if hosts, ok := r.hosts[host]; ok {
+		return hosts, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (r *stubResolver) LookupSRV(ctx gcontext.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if srvs, ok := r.srvs[name]; ok {
+		return name, srvs, nil
+	}
+	return "", nil, errors.New("no such host")
+}
+
+func TestFileSeeds(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "seeds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var path = filepath.Join(dir, "seeds")
+	ioutil.WriteFile(path, []byte("# seeds\n127.0.0.1:7946\n\n 127.0.0.2:7946 \n"), 0644)
+
+	var f = NewFileSeeds(path)
+	var seeds, _ = f.Discover(context.Simple())
+	if len(seeds) != 2 || seeds[1] != "127.0.0.2:7946" {
+		t.Errorf("unexpected seeds %v", seeds)
+	}
+
+	// reload after modified
+	ioutil.WriteFile(path, []byte("127.0.0.3:7946\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if seeds, _ = f.Discover(context.Simple()); len(seeds) != 1 || seeds[0] != "127.0.0.3:7946" {
+		t.Errorf("seeds should be reloaded, got %v", seeds)
+	}
+}
+
+func TestDNSSeeds(t *testing.T) {
+	var r = &stubResolver{
+		hosts: map[string][]string{"seeds.local": {"10.0.0.1", "10.0.0.2"}},
+		srvs:  map[string][]*net.SRV{"_gossip._udp.local": {{Target: "10.0.0.3.", Port: 8000}}},
+	}
+	var seeds, err = (&DNSSeeds{Name: "seeds.local", Port: 7946, Resolver: r}).Discover(context.Simple())
+	if err != nil || len(seeds) != 2 || seeds[0] != "10.0.0.1:7946" {
+		t.Errorf("unexpected A seeds %v, %v", seeds, err)
+	}
+	seeds, err = (&DNSSeeds{Name: "_gossip._udp.local", SRV: true, Resolver: r}).Discover(context.Simple())
+	if err != nil || len(seeds) != 1 || seeds[0] != "10.0.0.3:8000" {
+		t.Errorf("unexpected SRV seeds %v, %v", seeds, err)
+	}
+	if _, err = (&DNSSeeds{Name: "seeds.local", Resolver: r}).Discover(context.Simple()); err == nil {
+		t.Error("port should be required for A records")
+	}
+}
+
+func TestDiscoverSeeds(t *testing.T) {
+	var s = NewServer("a", "")
+	s.ctx = context.Simple()
+	s.Bootstraps = []string{"127.0.0.1:7001", "127.0.0.1:7000"}
+	var round = 0
+	s.Discoverer = DiscoverFunc(func(ctx context.Context) ([]string, error) {
+		round++
+		if round == 1 {
+			return []string{"127.0.0.1:7002", "127.0.0.1:7001", "bad address"}, nil
+		}
+		return nil, errors.New("unavailable")
+	})
+
+	var seeds = s.discoverSeeds("127.0.0.1:7000")
+	if len(seeds) != 2 || seeds[0] != "127.0.0.1:7001" || seeds[1] != "127.0.0.1:7002" {
+		t.Errorf("unexpected seeds %v", seeds)
+	}
+	if offlines := s.updateSeeds(seeds); len(offlines) != 2 {
+		t.Errorf("unexpected offline seeds %v", offlines)
+	}
+	s.bootstraps["127.0.0.1:7001"] = true
+
+	// failed discoverer does not affect the static seeds, and online state is kept
+	seeds = s.discoverSeeds("127.0.0.1:7000")
+	if offlines := s.updateSeeds(seeds); len(seeds) != 1 || len(offlines) != 0 {
+		t.Errorf("unexpected seeds %v, offline %v", seeds, offlines)
+	}
+}
+
+func TestDiscoverSeedsTimeout(t *testing.T) {
+	var s = NewServer("a", "")
+	s.ctx = context.Simple()
+	s.Config.TCPTimeout = 50 * time.Millisecond
+	s.Bootstraps = []string{"127.0.0.1:7001"}
+	var block = make(chan struct{})
+	defer close(block)
+	s.Discoverer = DiscoverFunc(func(ctx context.Context) ([]string, error) {
+		// ignore ctx
+		<-block
+		return []string{"127.0.0.1:7002"}, nil
+	})
+
+	var start = time.Now()
+	var seeds = s.discoverSeeds("127.0.0.1:7000")
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("discovery should be bounded, took %s", d)
+	}
+	if len(seeds) != 1 || seeds[0] != "127.0.0.1:7001" {
+		t.Errorf("unexpected seeds %v", seeds)
+	}
+}
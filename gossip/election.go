@@ -0,0 +1,141 @@
+package gossip
+
+import (
+	"sync"
+	"time"
+)
+
+// ElectionOptions is the options of election
+type ElectionOptions struct {
+	// Filter select the eligible nodes, all nodes are eligible if nil
+	Filter PeerFilter
+	// Less decide the priority of candidates, the minimum one will be the leader,
+	// default compare by name
+	Less func(a, b *Node) bool
+	// Stabilize is how long the candidate must be unchanged before taking leadership,
+	// it avoids leader churn while membership flapping, default 3 seconds
+	Stabilize time.Duration
+}
+
+// Election elect a leader deterministically from the current membership,
+// all nodes with the same view of membership will get the same leader
+type Election struct {
+	srv    *Server
+	opts   ElectionOptions
+	cancel func()
+
+	mu        sync.Mutex
+	leader    string
+	candidate string
+	timer     *time.Timer
+	changes   chan string
+}
+
+// NewElection start an election following the membership of server
+func NewElection(srv *Server, opts ElectionOptions) *Election {
+	if opts.Less == nil {
+		opts.Less = func(a, b *Node) bool {
+			return a.Name < b.Name
+		}
+	}
+	if opts.Stabilize <= 0 {
+		opts.Stabilize = 3 * time.Second
+	}
+	var e = &Election{
+		srv:     srv,
+		opts:    opts,
+		changes: make(chan string, 1),
+	}
+	e.cancel = srv.watchMembers(e.membersChanged)
+	e.membersChanged()
+	return e
+}
+
+// Leader return the name of current leader, empty if not elected yet
+func (e *Election) Leader() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// IsLeader return true if local node is the leader
+func (e *Election) IsLeader() bool {
+	var leader = e.Leader()
+	return leader != "" && leader == e.srv.localName()
+}
+
+// Changes return the channel of new leader name.
+// Only the latest leader is kept if the receiver is slow,
+// empty name means there is no eligible node.
+func (e *Election) Changes() <-chan string {
+	return e.changes
+}
+
+// Close stop following the membership
+func (e *Election) Close() {
+	e.cancel()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+}
+
+func (e *Election) elect() string {
+	var best *Node
+	for _, n := range e.srv.Select(e.opts.Filter) {
+		if best == nil || e.opts.Less(n, best) {
+			best = n
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.Name
+}
+
+func (e *Election) membersChanged() {
+	// 持锁计算候选人，并发的成员变更按顺序读取最新的成员，旧的候选人不会覆盖新的
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var candidate = e.elect()
+	if candidate == e.candidate && e.timer != nil {
+		// 候选人未变化，继续等待
+		return
+	}
+	e.candidate = candidate
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	if candidate == e.leader {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(e.opts.Stabilize, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.timer != timer {
+			// 已经被取消或者替换
+			return
+		}
+		e.timer = nil
+		e.setLeader(e.candidate)
+	})
+	e.timer = timer
+}
+
+// setLeader 必须持有锁
+func (e *Election) setLeader(leader string) {
+	if leader == e.leader {
+		return
+	}
+	e.leader = leader
+	// 丢弃未被接收的旧值，只保留最新的
+	select {
+	case <-e.changes:
+	default:
+	}
+	e.changes <- leader
+}
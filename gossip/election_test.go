@@ -0,0 +1,93 @@
+package gossip
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func TestElection(t *testing.T) {
+	var s = NewServer("b", "")
+	s.name = "b"
+	s.nodeOnline(newNode(&memberlist.Node{Name: "b"}))
+	s.nodeOnline(newNode(&memberlist.Node{Name: "c"}))
+
+	var e = NewElection(s, ElectionOptions{Stabilize: 50 * time.Millisecond})
+	defer e.Close()
+	if e.Leader() != "" {
+		t.Error("leader should not be elected before stabilized")
+	}
+	select {
+	case leader := <-e.Changes():
+		if leader != "b" || !e.IsLeader() {
+			t.Errorf("b should be the leader, got %s", leader)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("leader not elected")
+	}
+
+	// flapping node should not take leadership
+	var a = newNode(&memberlist.Node{Name: "a"})
+	s.nodeOnline(a)
+	time.Sleep(10 * time.Millisecond)
+	s.nodeOffline(a)
+	time.Sleep(100 * time.Millisecond)
+	if e.Leader() != "b" {
+		t.Errorf("leader should not churn, got %s", e.Leader())
+	}
+	select {
+	case leader := <-e.Changes():
+		t.Errorf("unexpected leader change %s", leader)
+	default:
+	}
+
+	s.nodeOnline(a)
+	select {
+	case leader := <-e.Changes():
+		if leader != "a" || e.IsLeader() {
+			t.Errorf("a should be the leader, got %s", leader)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("leader not changed")
+	}
+}
+
+func TestElectionConcurrentChanges(t *testing.T) {
+	var s = NewServer("z", "")
+	s.name = "z"
+	s.nodeOnline(newNode(&memberlist.Node{Name: "z"}))
+	var once sync.Once
+	var e = NewElection(s, ElectionOptions{
+		Stabilize: 50 * time.Millisecond,
+		// the first view with a is computed slowly
+		Less: func(x, y *Node) bool {
+			if x.Name == "a" || y.Name == "a" {
+				once.Do(func() { time.Sleep(50 * time.Millisecond) })
+			}
+			return x.Name < y.Name
+		},
+	})
+	defer e.Close()
+	select {
+	case <-e.Changes():
+	case <-time.After(time.Second):
+		t.Fatal("leader not elected")
+	}
+
+	// a leaves while the view with a is being computed, the stale candidate should not win
+	var a = newNode(&memberlist.Node{Name: "a"})
+	var done = make(chan struct{})
+	go func() {
+		s.nodeOnline(a)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.nodeOffline(a)
+	<-done
+	time.Sleep(100 * time.Millisecond)
+	if leader := e.Leader(); leader != "z" {
+		t.Errorf("z should be the leader, got %q", leader)
+	}
+}
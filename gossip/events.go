@@ -0,0 +1,195 @@
+package gossip
+
+import (
+	"sync"
+
+	"github.com/cjey/gbase/context"
+)
+
+// MemberEventType is the type of membership event
+type MemberEventType int
+
+const (
+	// MemberJoin node joined or online
+	MemberJoin MemberEventType = iota
+	// MemberLeave node left or offline
+	MemberLeave
+	// MemberUpdate node's metadata updated
+	MemberUpdate
+	// MemberPing node's rtt measured by ping
+	MemberPing
+	// MemberSuspect node is suspected as failed by MemberEvent.From, see FailureDelegate
+	MemberSuspect
+	// MemberConflict another node claims the same name as Node, see MemberEvent.Other
+	MemberConflict
+	// MemberRefute suspected node acked the probes of MemberEvent.From again, see FailureDelegate
+	MemberRefute
+	// MemberDead node went offline without announcing its leave, it's followed by MemberLeave
+	MemberDead
+)
+
+func (t MemberEventType) String() string {
+	switch t {
+	case MemberJoin:
+		return "join"
+	case MemberLeave:
+		return "leave"
+	case MemberUpdate:
+		return "update"
+	case MemberPing:
+		return "ping"
+	case MemberSuspect:
+		return "suspect"
+	case MemberConflict:
+		return "conflict"
+	case MemberRefute:
+		return "refute"
+	case MemberDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// MemberEvent is a membership event
+type MemberEvent struct {
+	Type MemberEventType
+	Node *Node
+	// Other is the node claiming the same name in MemberConflict event
+	Other *Node
+	// From is the node which suspected Node in MemberSuspect, MemberRefute and MemberDead event, empty if unknown
+	From string
+	// Missed is the number of events dropped right before this one,
+	// because the subscriber did not receive in time
+	Missed uint64
+}
+
+// DefaultMemberEventBuffer is the default buffer size of member event subscriber
+const DefaultMemberEventBuffer = 64
+
+// memberSubscriber 事件先进入自己的队列，再由run逐个交给订阅者，
+// channel中的事件无法修改，丢弃的数量只能在队列中记到紧随其后的事件上
+type memberSubscriber struct {
+	mu sync.Mutex
+	// 等待投递的事件，最多buffer个，不含正在投递的那个
+	queue  []MemberEvent
+	buffer int
+	kick   chan struct{}
+	ch     chan MemberEvent
+	closed bool
+}
+
+func newMemberSubscriber(buffer int) *memberSubscriber {
+	return &memberSubscriber{
+		buffer: buffer,
+		kick:   make(chan struct{}, 1),
+		ch:     make(chan MemberEvent),
+	}
+}
+
+// send 非阻塞投递，队列满时丢弃最旧的事件，它和它之前丢弃的数量都记到新的队首上
+func (sub *memberSubscriber) send(ev MemberEvent) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	if len(sub.queue) >= sub.buffer {
+		var missed = sub.queue[0].Missed + 1
+		sub.queue = sub.queue[1:]
+		if len(sub.queue) > 0 {
+			sub.queue[0].Missed += missed
+		} else {
+			ev.Missed += missed
+		}
+	}
+	sub.queue = append(sub.queue, ev)
+	select {
+	case sub.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (sub *memberSubscriber) pop() (MemberEvent, bool) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if len(sub.queue) == 0 {
+		return MemberEvent{}, false
+	}
+	var ev = sub.queue[0]
+	sub.queue = sub.queue[1:]
+	return ev, true
+}
+
+// run 按顺序投递队列中的事件，ctx结束后丢弃剩余的事件并关闭channel
+func (sub *memberSubscriber) run(ctx context.Context) {
+	defer func() {
+		sub.mu.Lock()
+		sub.closed = true
+		sub.queue = nil
+		sub.mu.Unlock()
+		close(sub.ch)
+	}()
+	for {
+		var ev, ok = sub.pop()
+		if !ok {
+			select {
+			case <-sub.kick:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case sub.ch <- ev:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type memberEvents struct {
+	mu   sync.RWMutex
+	subs map[*memberSubscriber]struct{}
+}
+
+func newMemberEvents() *memberEvents {
+	return &memberEvents{
+		subs: make(map[*memberSubscriber]struct{}),
+	}
+}
+
+func (e *memberEvents) publish(t MemberEventType, node *Node) {
+	e.publishEvent(MemberEvent{Type: t, Node: node})
+}
+
+func (e *memberEvents) publishEvent(ev MemberEvent) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for sub := range e.subs {
+		sub.send(ev)
+	}
+}
+
+// SubscribeMembers return a channel of membership events, it's closed after ctx done,
+// and the events not received yet are discarded.
+// Every subscriber has it's own buffer (DefaultMemberEventBuffer if buffer <= 0),
+// it never blocks the gossip server, if the buffer is full, the oldest event is dropped,
+// and the number of dropped events is reported by MemberEvent.Missed of the event right after them.
+// It's not named Subscribe, which is the subscription of topics.
+func (s *Server) SubscribeMembers(ctx context.Context, buffer int) <-chan MemberEvent {
+	if buffer <= 0 {
+		buffer = DefaultMemberEventBuffer
+	}
+	var sub = newMemberSubscriber(buffer)
+	s.events.mu.Lock()
+	s.events.subs[sub] = struct{}{}
+	s.events.mu.Unlock()
+
+	go func() {
+		sub.run(ctx)
+		s.events.mu.Lock()
+		delete(s.events.subs, sub)
+		s.events.mu.Unlock()
+	}()
+	return sub.ch
+}
@@ -0,0 +1,71 @@
+package gossip
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+
+	"github.com/cjey/gbase/context"
+)
+
+func TestSubscribeMembers(t *testing.T) {
+	var s = NewServer("a", "")
+	var ctx, cancel = context.Simple().WithCancel()
+	var slow = s.SubscribeMembers(ctx, 2)
+	var fast = s.SubscribeMembers(ctx, 0)
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		s.events.publish(MemberJoin, newNode(&memberlist.Node{Name: name}))
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if ev := <-fast; ev.Type != MemberJoin || ev.Node.Name != name || ev.Missed != 0 {
+			t.Errorf("unexpected event %v %s %d", ev.Type, ev.Node.Name, ev.Missed)
+		}
+	}
+
+	// slow subscriber only keeps the latest events, the gaps are reported where they are
+	var names = map[string]int{"a": 0, "b": 1, "c": 2, "d": 3}
+	for last := -1; last < 3; {
+		var ev = <-slow
+		if names[ev.Node.Name] != last+1+int(ev.Missed) {
+			t.Errorf("unexpected event %s after %d, missed %d", ev.Node.Name, last, ev.Missed)
+		}
+		last = names[ev.Node.Name]
+	}
+
+	cancel()
+	select {
+	case _, ok := <-fast:
+		if ok {
+			t.Error("channel should be closed")
+		}
+	case <-time.After(time.Second):
+		t.Error("channel should be closed after ctx done")
+	}
+}
+
+func TestMemberSubscriberMissed(t *testing.T) {
+	var sub = newMemberSubscriber(2)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		sub.send(MemberEvent{Node: &Node{Name: name}})
+	}
+	// a, b and c are dropped in turn, all of them are right before d
+	var got []string
+	for ev, ok := sub.pop(); ok; ev, ok = sub.pop() {
+		got = append(got, fmt.Sprintf("%s/%d", ev.Node.Name, ev.Missed))
+	}
+	if strings.Join(got, " ") != "d/3 e/0" {
+		t.Errorf("unexpected events %v", got)
+	}
+
+	sub = newMemberSubscriber(1)
+	for _, name := range []string{"a", "b", "c"} {
+		sub.send(MemberEvent{Node: &Node{Name: name}})
+	}
+	if ev, _ := sub.pop(); ev.Node.Name != "c" || ev.Missed != 2 {
+		t.Errorf("unexpected event %s/%d", ev.Node.Name, ev.Missed)
+	}
+}
@@ -0,0 +1,343 @@
+package gossip
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// FailureDelegate is an optional interface of Delegate, if implemented,
+// it's notified of the failures observed by the cluster.
+// from is the node which suspected the node, empty if unknown.
+//
+// memberlist reports neither suspicion nor refutation to any delegate, so they are derived from
+// the direct probes: a node suspects a peer which hasn't acked its probes for about two rounds of
+// probing, and refutes the suspicion once the peer acks again, both are broadcast to the others.
+// They are independent of the suspicion inside memberlist, a suspected node is not necessarily
+// declared dead, and a node may be declared dead without any suspicion.
+//
+// NotifyDead is called for a node left without announcing its leave, e.g. crashed or partitioned.
+// The leave is announced before stopping, which delays the stop for up to half of the leave timeout,
+// it's best-effort: if the notice is lost or dropped, the peers report the node as dead.
+type FailureDelegate interface {
+	// NotifySuspect notify the node is suspected as failed
+	NotifySuspect(node *Node, from string)
+	// NotifyRefute notify the suspected node acked the probes again
+	NotifyRefute(node *Node, from string)
+	// NotifyDead notify the node is declared dead, it's followed by NotifyLeave
+	NotifyDead(node *Node, from string)
+}
+
+// memberlist不会把其他节点的怀疑通知上层，所以由发起怀疑或者反驳的节点广播一条通知
+// memberlist也不区分主动离开和死亡，所以主动离开的节点在离开前先广播一条通知
+const (
+	_FAILURE_SUSPECT = 1
+	_FAILURE_REFUTE  = 2
+	_FAILURE_LEAVE   = 3
+)
+
+// 通知格式：
+// type(1) | uvarint(len(node)) | node | uvarint(len(from)) | from
+func encodeFailureNotice(typ byte, node, from string) []byte {
+	var buf = make([]byte, 0, 1+2*binary.MaxVarintLen64+len(node)+len(from))
+	buf = append(buf, typ)
+	buf = appendString(buf, node)
+	return appendString(buf, from)
+}
+
+func decodeFailureNotice(buf []byte) (typ byte, node, from string, err error) {
+	if len(buf) == 0 {
+		return 0, "", "", errMalformedMessage
+	}
+	typ, buf = buf[0], buf[1:]
+	if node, buf, err = readString(buf); err != nil {
+		return 0, "", "", err
+	}
+	if from, _, err = readString(buf); err != nil {
+		return 0, "", "", err
+	}
+	return typ, node, from, nil
+}
+
+// suspecters 记录每个节点最近一次被谁怀疑，用于补全dead事件的来源，
+// 以及哪些节点宣告了主动离开，用于区分离开和死亡，
+// 还记录每个节点最近一次应答本节点直接探测的时间，用于本节点发起怀疑
+type suspecters struct {
+	mu sync.Mutex
+	// key<node name> => value<suspecter name>
+	m map[string]string
+	// key<node name> => value<announced leave>
+	left map[string]bool
+	// key<node name> => value<last ack time>
+	acks map[string]time.Time
+	// key<node name> => value<suspected by local node>
+	local map[string]bool
+}
+
+func newSuspecters() *suspecters {
+	return &suspecters{
+		m:     make(map[string]string),
+		left:  make(map[string]bool),
+		acks:  make(map[string]time.Time),
+		local: make(map[string]bool),
+	}
+}
+
+// joined 节点（重新）加入，清除上一次的状态，从加入时开始计算探测超时
+func (sp *suspecters) joined(node string, now time.Time) {
+	sp.mu.Lock()
+	delete(sp.m, node)
+	delete(sp.left, node)
+	delete(sp.local, node)
+	sp.acks[node] = now
+	sp.mu.Unlock()
+}
+
+// forget 节点离开后不再探测
+func (sp *suspecters) forget(node string) {
+	sp.mu.Lock()
+	delete(sp.acks, node)
+	delete(sp.local, node)
+	sp.mu.Unlock()
+}
+
+// acked 节点应答了本节点的直接探测，返回它是否正在被本节点怀疑
+func (sp *suspecters) acked(node string, now time.Time) bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.acks[node] = now
+	var suspected = sp.local[node]
+	delete(sp.local, node)
+	return suspected
+}
+
+// overdue 返回在deadline之前就不再应答、且尚未被本节点怀疑的节点，并标记为已怀疑
+// 从未记录过的节点从现在开始计算
+func (sp *suspecters) overdue(nodes []string, deadline, now time.Time) []string {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	var names []string
+	for _, name := range nodes {
+		var last, ok = sp.acks[name]
+		switch {
+		case !ok:
+			sp.acks[name] = now
+		case last.Before(deadline) && !sp.local[name]:
+			sp.local[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (sp *suspecters) setLeft(node string) {
+	sp.mu.Lock()
+	sp.left[node] = true
+	sp.mu.Unlock()
+}
+
+// takeLeft 节点重新加入时也需要清除，避免下一次死亡被当成离开
+func (sp *suspecters) takeLeft(node string) bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	var left = sp.left[node]
+	delete(sp.left, node)
+	return left
+}
+
+func (sp *suspecters) set(node, from string) {
+	sp.mu.Lock()
+	sp.m[node] = from
+	sp.mu.Unlock()
+}
+
+func (sp *suspecters) has(node string) bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	var _, ok = sp.m[node]
+	return ok
+}
+
+func (sp *suspecters) take(node string) string {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	var from = sp.m[node]
+	delete(sp.m, node)
+	return from
+}
+
+// failureDelegate 返回当前运行周期的Delegate，未实现FailureDelegate时返回nil
+func (s *Server) failureDelegate() FailureDelegate {
+	var sender = s.currentSender()
+	if sender == nil || sender.dgm == nil {
+		return nil
+	}
+	var fd, _ = sender.dgm.dg.(FailureDelegate)
+	return fd
+}
+
+// broadcastFailure 通知其他节点本节点观察到的怀疑或者反驳
+func (s *Server) broadcastFailure(typ byte, node, from string) {
+	var sender = s.currentSender()
+	if sender == nil {
+		return
+	}
+	var msg = encodeMessage(kindFailure, encodeFailureNotice(typ, node, from))
+	sender.queueBroadcast(PriorityControl, broadcast(msg))
+}
+
+// leaveBroadcast 离开通知传输完成或者被丢弃后关闭done
+type leaveBroadcast struct {
+	msg  []byte
+	done chan struct{}
+}
+
+func (b *leaveBroadcast) Invalidates(memberlist.Broadcast) bool {
+	return false
+}
+
+func (b *leaveBroadcast) Message() []byte {
+	return b.msg
+}
+
+func (b *leaveBroadcast) Finished() {
+	close(b.done)
+}
+
+// announceLeave 在memberlist广播离开之前通知其他节点本节点是主动离开，最多等待timeout
+// memberlist先处理同一个包中自己的消息，若同时发出，其他节点会先判定本节点死亡
+func (s *Server) announceLeave(timeout time.Duration) {
+	var sender = s.currentSender()
+	if sender == nil || len(s.Others()) == 0 {
+		return
+	}
+	var b = &leaveBroadcast{
+		msg:  encodeMessage(kindFailure, encodeFailureNotice(_FAILURE_LEAVE, s.localName(), "")),
+		done: make(chan struct{}),
+	}
+	if !sender.queueBroadcast(PriorityControl, b) {
+		return
+	}
+	var timer = time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-b.done:
+	case <-timer.C:
+	}
+}
+
+// probeTimeout 节点多久没有应答直接探测后被怀疑
+// memberlist每个探测周期探测一个节点，每一轮打乱顺序，所以同一个节点两次探测最多相隔两轮，
+// 本节点健康状况变差时探测周期也会按比例延长，再多留一个周期和一次探测超时的余量
+func probeTimeout(cfg *memberlist.Config, others, health int) time.Duration {
+	return time.Duration((2*others+1)*(health+1))*cfg.ProbeInterval + cfg.ProbeTimeout
+}
+
+// watchProbes 每个探测周期检查一次，怀疑长时间未应答直接探测的节点
+func (s *Server) watchProbes(shutsig chan struct{}) {
+	var ticker = time.NewTicker(s.Config.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutsig:
+			return
+		case now := <-ticker.C:
+			s.checkProbes(now)
+		}
+	}
+}
+
+func (s *Server) checkProbes(now time.Time) {
+	var others = s.Others()
+	if len(others) == 0 {
+		return
+	}
+	var health int
+	if ml := s.currentMemberlist(); ml != nil {
+		health = ml.GetHealthScore()
+	}
+	var names = make([]string, 0, len(others))
+	for _, node := range others {
+		names = append(names, node.Name)
+	}
+	var deadline = now.Add(-probeTimeout(s.Config, len(others), health))
+	for _, name := range s.suspecters.overdue(names, deadline, now) {
+		if node := s.Peer(name); node != nil {
+			s.nodeSuspect(node, s.localName(), true)
+		}
+	}
+}
+
+// nodeAcked 节点应答了本节点的直接探测，如果它正被本节点怀疑，则反驳
+func (s *Server) nodeAcked(node *Node) {
+	if s.suspecters.acked(node.Name, time.Now()) {
+		s.nodeRefute(node, s.localName(), true)
+	}
+}
+
+// nodeSuspect origin表示由本节点发起的怀疑，需要广播给其他节点
+func (s *Server) nodeSuspect(node *Node, from string, origin bool) {
+	s.count(&s.stats.suspects, "gossip.suspect", 1)
+	if origin {
+		s.broadcastFailure(_FAILURE_SUSPECT, node.Name, from)
+	}
+	s.suspecters.set(node.Name, from)
+	s.events.publishEvent(MemberEvent{Type: MemberSuspect, Node: node, From: from})
+	if fd := s.failureDelegate(); fd != nil {
+		fd.NotifySuspect(node, from)
+	}
+}
+
+// nodeRefute origin表示本节点收到了被怀疑节点的应答，需要广播给其他节点
+func (s *Server) nodeRefute(node *Node, from string, origin bool) {
+	s.count(&s.stats.refutes, "gossip.refute", 1)
+	if origin {
+		s.broadcastFailure(_FAILURE_REFUTE, node.Name, from)
+	}
+	s.suspecters.take(node.Name)
+	s.events.publishEvent(MemberEvent{Type: MemberRefute, Node: node, From: from})
+	if fd := s.failureDelegate(); fd != nil {
+		fd.NotifyRefute(node, from)
+	}
+}
+
+// nodeDead 节点未宣告离开便下线，来源是最近一次怀疑它的节点，未被怀疑过时未知
+func (s *Server) nodeDead(node *Node) {
+	var from = s.suspecters.take(node.Name)
+	s.count(&s.stats.deaths, "gossip.dead", 1)
+	s.events.publishEvent(MemberEvent{Type: MemberDead, Node: node, From: from})
+	if fd := s.failureDelegate(); fd != nil {
+		fd.NotifyDead(node, from)
+	}
+}
+
+// notifyFailure 处理其他节点广播的怀疑或者反驳通知
+func (s *Server) notifyFailure(msg []byte) {
+	var typ, name, from, err = decodeFailureNotice(msg)
+	if err != nil {
+		return
+	}
+	if typ == _FAILURE_LEAVE {
+		if name != s.localName() && s.Peer(name) != nil {
+			s.suspecters.setLeft(name)
+		}
+		return
+	}
+	var node = s.Peer(name)
+	if node == nil {
+		return
+	}
+	// 本节点发出的通知已经在本地处理过，对本节点的怀疑由memberlist反驳
+	switch typ {
+	case _FAILURE_SUSPECT:
+		if from != s.localName() && name != s.localName() {
+			s.nodeSuspect(node, from, false)
+		}
+	case _FAILURE_REFUTE:
+		if name != s.localName() {
+			s.nodeRefute(node, from, false)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package gossip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+
+	"github.com/cjey/gbase/context"
+)
+
+func TestFailureEvents(t *testing.T) {
+	var s = NewServer("a", "")
+	s.name = "a"
+	s.sender = newSender(s, nil)
+	for _, name := range []string{"a", "b", "c"} {
+		s.peers[name] = newNode(&memberlist.Node{Name: name})
+	}
+	var now = time.Now()
+	s.suspecters.joined("b", now)
+	var ctx, cancel = context.Simple().WithCancel()
+	defer cancel()
+	var evs = s.SubscribeMembers(ctx, 16)
+
+	var expect = func(typ MemberEventType, node, from string) {
+		t.Helper()
+		if ev := <-evs; ev.Type != typ || ev.Node.Name != node || ev.From != from {
+			t.Errorf("expect %v %s from %q, got %v %s from %q", typ, node, from, ev.Type, ev.Node.Name, ev.From)
+		}
+	}
+
+	// b stopped acking the probes, c is watched from now on, local suspicion is broadcast to the others
+	s.checkProbes(now.Add(time.Hour))
+	expect(MemberSuspect, "b", "a")
+	if n := s.Stats().BroadcastsQueued; n != 1 {
+		t.Errorf("suspicion should be broadcast, %d queued", n)
+	}
+	// suspected only once
+	s.checkProbes(now.Add(time.Hour))
+
+	// notices from the others, the ones about or from local node are ignored
+	s.notifyFailure(encodeFailureNotice(_FAILURE_SUSPECT, "b", "a"))
+	s.notifyFailure(encodeFailureNotice(_FAILURE_SUSPECT, "a", "c"))
+	s.notifyFailure(encodeFailureNotice(_FAILURE_SUSPECT, "c", "b"))
+	expect(MemberSuspect, "c", "b")
+	s.notifyFailure(encodeFailureNotice(_FAILURE_REFUTE, "b", "c"))
+	expect(MemberRefute, "b", "c")
+
+	// b acked the probe of local node again
+	s.nodePing(s.Peer("b"), time.Millisecond)
+	expect(MemberRefute, "b", "a")
+	if n := s.Stats().BroadcastsQueued; n != 2 {
+		t.Errorf("refutation should be broadcast, %d queued", n)
+	}
+	s.nodePing(s.Peer("b"), time.Millisecond)
+
+	// dead event carries the last suspecter
+	s.nodeDead(s.Peer("c"))
+	expect(MemberDead, "c", "b")
+	s.nodeDead(s.Peer("b"))
+	expect(MemberDead, "b", "")
+
+	var st = s.Stats()
+	if st.Suspects != 2 || st.Refutes != 2 || st.Deaths != 2 {
+		t.Errorf("unexpected failure stats %+v", st)
+	}
+	select {
+	case ev := <-evs:
+		t.Errorf("unexpected event %v %s", ev.Type, ev.Node.Name)
+	default:
+	}
+}
+
+func TestFailureProbeTimeout(t *testing.T) {
+	var cfg = memberlist.DefaultLANConfig()
+	cfg.ProbeInterval, cfg.ProbeTimeout = time.Second, 200*time.Millisecond
+	for _, c := range []struct {
+		others, health int
+		expect         time.Duration
+	}{
+		{1, 0, 3200 * time.Millisecond},
+		{4, 0, 9200 * time.Millisecond},
+		{4, 2, 27200 * time.Millisecond},
+	} {
+		if d := probeTimeout(cfg, c.others, c.health); d != c.expect {
+			t.Errorf("%d others with health %d, expect %s, got %s", c.others, c.health, c.expect, d)
+		}
+	}
+
+	var sp = newSuspecters()
+	var now = time.Now()
+	sp.joined("b", now)
+	if names := sp.overdue([]string{"b"}, now, now); len(names) != 0 {
+		t.Errorf("b acked in time, got %v", names)
+	}
+	if names := sp.overdue([]string{"b"}, now.Add(time.Nanosecond), now); len(names) != 1 {
+		t.Errorf("b should be overdue, got %v", names)
+	}
+	// a rejoined node is watched from the beginning
+	sp.joined("b", now.Add(time.Second))
+	if sp.acked("b", now.Add(time.Second)) {
+		t.Errorf("suspicion should be cleared by rejoin")
+	}
+	sp.forget("b")
+	if names := sp.overdue([]string{"b"}, now.Add(time.Hour), now); len(names) != 0 {
+		t.Errorf("forgotten node is watched from now on, got %v", names)
+	}
+}
@@ -17,17 +17,28 @@ type Node struct {
 	Port uint16
 	Meta []byte
 	RTT  time.Duration
+
+	tags     Tags
+	cluster  string
+	protocol uint32
+	started  int64
 }
 
 func newNode(node *memberlist.Node) *Node {
+	var m = decodeMeta(node.Meta)
 	return &Node{
 		node: node,
 
 		Name: node.Name,
 		Addr: node.Addr,
 		Port: node.Port,
-		Meta: node.Meta,
+		Meta: m.meta,
 		RTT:  -1,
+
+		tags:     m.tags,
+		cluster:  m.cluster,
+		protocol: m.protocol,
+		started:  m.started,
 	}
 }
 
@@ -47,7 +58,7 @@ type Delegate interface {
 	// announce gossip server started
 	GossipStarted(*Sender)
 
-	// Metadata get local node meta data
+	// Metadata get local node meta data, the limit excludes the size of tags
 	Metadata(limit int) []byte
 	// NotifyJoin notify node join or node online
 	NotifyJoin(*Node)
@@ -0,0 +1,187 @@
+// Package gossiptest spin up multiple gossip servers in one process over an in-memory network,
+// it is used for writing deterministic tests of gossip delegates without real sockets.
+package gossiptest
+
+import (
+	gcontext "context"
+	"fmt"
+	"time"
+
+	"github.com/cjey/gbase/context"
+	"github.com/cjey/gbase/gossip"
+)
+
+// Cluster is a group of gossip servers on the same in-memory network
+type Cluster struct {
+	Network *Network
+	Servers []*gossip.Server
+
+	addrs  []string
+	ctx    context.Context
+	cancel context.CancelFunc
+	errs   chan error
+}
+
+// LocalConfig tune the server for in-process test, make it converge quickly
+func LocalConfig(srv *gossip.Server) {
+	var cfg = srv.Config
+	cfg.TCPTimeout = time.Second
+	cfg.ProbeInterval = 100 * time.Millisecond
+	cfg.ProbeTimeout = 50 * time.Millisecond
+	cfg.SuspicionMult = 2
+	cfg.GossipInterval = 10 * time.Millisecond
+	cfg.GossipToTheDeadTime = time.Second
+	cfg.PushPullInterval = time.Second
+}
+
+// NewCluster start n servers named node-0 ... node-<n-1>, all nodes use node-0 as bootstrap.
+// setup is optional, it's called before serving, e.g. to register delegate.
+func NewCluster(n int, setup func(i int, srv *gossip.Server)) (*Cluster, error) {
+	var ctx, cancel = context.New(gcontext.Background(), nil, nil).WithCancel()
+	var c = &Cluster{
+		Network: NewNetwork(),
+		ctx:     ctx,
+		cancel:  cancel,
+		errs:    make(chan error, n),
+	}
+	for i := 0; i < n; i++ {
+		var addr = fmt.Sprintf("127.0.0.1:%d", 10000+i)
+		var t, err = c.Network.NewTransport(addr)
+		if err != nil {
+			c.Shutdown()
+			return nil, err
+		}
+		var srv = gossip.NewServer(fmt.Sprintf("node-%d", i), "")
+		LocalConfig(srv)
+		srv.Config.Transport = t
+		if setup != nil {
+			setup(i, srv)
+		}
+		c.addrs = append(c.addrs, addr)
+		c.Servers = append(c.Servers, srv)
+	}
+	for i, srv := range c.Servers {
+		var bootstraps []string
+		if i > 0 {
+			bootstraps = c.addrs[:1]
+		}
+		go func(srv *gossip.Server, addr string) {
+			if err := srv.Serve(ctx, addr, bootstraps...); err != nil {
+				c.errs <- err
+			}
+		}(srv, c.addrs[i])
+	}
+	return c, nil
+}
+
+// Restart replace the i-th server by a new one of the same name and address, as if the process restarted,
+// all the state in memory is lost. setup is optional, same as NewCluster
+func (c *Cluster) Restart(i int, setup func(i int, srv *gossip.Server)) error {
+	var old = c.Servers[i]
+	var ctx, cancel = c.ctx.WithTimeout(time.Second)
+	var err = old.Stop(ctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	var srv = gossip.NewServer(fmt.Sprintf("node-%d", i), "")
+	LocalConfig(srv)
+	// the transport is kept by the stopped server
+	srv.Config.Transport = old.Config.Transport
+	if setup != nil {
+		setup(i, srv)
+	}
+	c.Servers[i] = srv
+	var seed = c.addrs[0]
+	if i == 0 && len(c.addrs) > 1 {
+		seed = c.addrs[1]
+	}
+	go func() {
+		if err := srv.Serve(c.ctx, c.addrs[i], seed); err != nil {
+			c.errs <- err
+		}
+	}()
+	select {
+	case <-srv.Ready():
+		return nil
+	case err := <-c.errs:
+		return err
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("node-%d is not ready after restart", i)
+	}
+}
+
+// Addr return the address of the i-th server
+func (c *Cluster) Addr(i int) string {
+	return c.addrs[i]
+}
+
+// Partition split the cluster into groups by server index
+func (c *Cluster) Partition(groups ...[]int) {
+	var addrs = make([][]string, len(groups))
+	for i, g := range groups {
+		for _, idx := range g {
+			addrs[i] = append(addrs[i], c.addrs[idx])
+		}
+	}
+	c.Network.Partition(addrs...)
+}
+
+// Heal remove all partitions
+func (c *Cluster) Heal() {
+	c.Network.Heal()
+}
+
+// WaitFor poll cond until it return true, or timeout
+func (c *Cluster) WaitFor(timeout time.Duration, cond func() bool) error {
+	var deadline = time.Now().Add(timeout)
+	for {
+		select {
+		case err := <-c.errs:
+			return err
+		default:
+		}
+		if cond() {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("condition not satisfied in %s", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// WaitConverged wait until every given server see exactly the given servers as peers,
+// all servers are checked if idx is empty
+func (c *Cluster) WaitConverged(timeout time.Duration, idx ...int) error {
+	if len(idx) == 0 {
+		for i := range c.Servers {
+			idx = append(idx, i)
+		}
+	}
+	return c.WaitFor(timeout, func() bool {
+		for _, i := range idx {
+			var peers = c.Servers[i].Peers()
+			if len(peers) != len(idx) {
+				return false
+			}
+			for _, j := range idx {
+				if c.Servers[i].Peer(fmt.Sprintf("node-%d", j)) == nil {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+// Shutdown stop all servers
+func (c *Cluster) Shutdown() {
+	for _, srv := range c.Servers {
+		var ctx, cancel = c.ctx.WithTimeout(200 * time.Millisecond)
+		srv.Shutdown(ctx)
+		cancel()
+	}
+	c.cancel()
+}
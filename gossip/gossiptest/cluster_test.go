@@ -0,0 +1,693 @@
+package gossiptest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+
+	"github.com/cjey/gbase/context"
+	"github.com/cjey/gbase/gossip"
+)
+
+func TestClusterConverge(t *testing.T) {
+	var c, err = NewCluster(3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	if err := c.WaitConverged(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Servers[0].KV().Set("hello", []byte("world"))
+	err = c.WaitFor(5*time.Second, func() bool {
+		for _, srv := range c.Servers {
+			if v, ok := srv.KV().Get("hello"); !ok || string(v) != "world" {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClusterPartition(t *testing.T) {
+	var c, err = NewCluster(3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	if err := c.WaitConverged(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Partition([]int{0, 1}, []int{2})
+	if err := c.WaitConverged(10*time.Second, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	// write on the minority side, it should converge after healing
+	c.Servers[2].KV().Set("side", []byte("minority"))
+
+	c.Heal()
+	err = c.WaitFor(15*time.Second, func() bool {
+		var v, ok = c.Servers[0].KV().Get("side")
+		return ok && string(v) == "minority"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClusterLoss(t *testing.T) {
+	var c, err = NewCluster(2, func(i int, srv *gossip.Server) {
+		srv.RPC().Register("echo", func(ctx context.Context, from string, req []byte) ([]byte, error) {
+			return req, nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	if err := c.WaitConverged(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	c.Network.SetLoss(0.3)
+	c.Network.SetLatency(5 * time.Millisecond)
+
+	var ctx = c.ctx
+	if resp, err := c.Servers[1].RPC().Call(ctx, "node-0", "echo", []byte("hi")); err != nil || string(resp) != "hi" {
+		t.Errorf("unexpected echo result %q, %v", resp, err)
+	}
+	if _, err := c.Servers[1].RPC().Call(ctx, "node-0", "missing", nil); err != gossip.ErrUnknownMethod {
+		t.Errorf("expect unknown method, got %v", err)
+	}
+	if _, err := c.Servers[1].RPC().Call(ctx, "node-9", "echo", nil); err != gossip.ErrUnknownNode {
+		t.Errorf("expect unknown node, got %v", err)
+	}
+
+	// retransmit should defeat the packet loss
+	c.Servers[0].KV().Set("k", []byte("v"))
+	err = c.WaitFor(10*time.Second, func() bool {
+		var _, ok = c.Servers[1].KV().Get("k")
+		return ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// legacyDelegate is the delegate of nodes before the message kind prefix, it only exchanges raw messages
+type legacyDelegate struct {
+	msgs chan []byte
+}
+
+func (d *legacyDelegate) NodeMeta(limit int) []byte                  { return nil }
+func (d *legacyDelegate) NotifyMsg(msg []byte)                       { d.msgs <- append([]byte(nil), msg...) }
+func (d *legacyDelegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (d *legacyDelegate) LocalState(join bool) []byte                { return nil }
+func (d *legacyDelegate) MergeRemoteState(buf []byte, join bool)     {}
+
+func TestClusterLegacyProtocol(t *testing.T) {
+	var got = make(chan []byte, 1)
+	var senders = make(chan *gossip.Sender, 1)
+	var c, err = NewCluster(1, func(i int, srv *gossip.Server) {
+		srv.RegisterDelegate(&gossip.DelegateFuncs{
+			GossipStartedFunc: func(s *gossip.Sender) { senders <- s },
+			NotifyMessageFunc: func(msg []byte) { got <- append([]byte(nil), msg...) },
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+	var sender = <-senders
+
+	tr, err := c.Network.NewTransport("127.0.0.1:10001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var legacy = &legacyDelegate{msgs: make(chan []byte, 1)}
+	var cfg = memberlist.DefaultLANConfig()
+	cfg.Name = "legacy"
+	cfg.Transport = tr
+	cfg.Delegate = legacy
+	cfg.LogOutput = ioutil.Discard
+	ml, err := memberlist.Create(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ml.Shutdown()
+	if _, err := ml.Join([]string{c.Addr(0)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitFor(5*time.Second, func() bool { return c.Servers[0].Peer("legacy") != nil }); err != nil {
+		t.Fatal("legacy node should join the cluster")
+	}
+
+	// raw messages are understood by both sides
+	var node0 *memberlist.Node
+	for _, m := range ml.Members() {
+		if m.Name == "node-0" {
+			node0 = m
+		}
+	}
+	if err := ml.SendReliable(node0, []byte("from legacy")); err != nil {
+		t.Fatal(err)
+	}
+	sender.SendReliable("legacy", []byte("to legacy"))
+	for _, c := range []struct {
+		ch   chan []byte
+		want string
+	}{{got, "from legacy"}, {legacy.msgs, "to legacy"}} {
+		select {
+		case msg := <-c.ch:
+			if string(msg) != c.want {
+				t.Errorf("expect %q, got %q", c.want, msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%q is not received", c.want)
+		}
+	}
+}
+
+func TestClusterLeaveAndDead(t *testing.T) {
+	var c, err = NewCluster(3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	if err := c.WaitConverged(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	var evs = c.Servers[0].SubscribeMembers(c.ctx, 64)
+	var wait = func(node string) []gossip.MemberEventType {
+		t.Helper()
+		var types []gossip.MemberEventType
+		var timeout = time.After(10 * time.Second)
+		for {
+			select {
+			case ev := <-evs:
+				if ev.Node.Name != node {
+					continue
+				}
+				types = append(types, ev.Type)
+				if ev.Type == gossip.MemberLeave {
+					return types
+				}
+			case <-timeout:
+				t.Fatalf("%s never left, got %v", node, types)
+			}
+		}
+	}
+
+	// graceful leave is not dead
+	var ctx, cancel = c.ctx.WithTimeout(2 * time.Second)
+	err = c.Servers[1].Stop(ctx)
+	cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range wait("node-1") {
+		if typ == gossip.MemberDead {
+			t.Errorf("node-1 left gracefully, should not be dead")
+		}
+	}
+
+	// unreachable is dead
+	c.Partition([]int{0}, []int{2})
+	var dead bool
+	for _, typ := range wait("node-2") {
+		dead = dead || typ == gossip.MemberDead
+	}
+	if !dead {
+		t.Errorf("node-2 is unreachable, should be dead")
+	}
+	if st := c.Servers[0].Stats(); st.Deaths != 1 {
+		t.Errorf("expect 1 death, got %d", st.Deaths)
+	}
+}
+
+func TestClusterSuspect(t *testing.T) {
+	var c, err = NewCluster(3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	if err := c.WaitConverged(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	var evs = make(chan gossip.MemberEvent, 64)
+	for _, srv := range c.Servers {
+		go func(ch <-chan gossip.MemberEvent) {
+			for ev := range ch {
+				evs <- ev
+			}
+		}(srv.SubscribeMembers(c.ctx, 64))
+	}
+
+	var wait = func(typ gossip.MemberEventType) {
+		t.Helper()
+		var timeout = time.After(10 * time.Second)
+		for {
+			select {
+			case ev := <-evs:
+				if ev.Type == typ && ev.Node.Name == "node-2" {
+					if ev.From != "node-0" {
+						t.Errorf("%v of node-2 from %q", typ, ev.From)
+					}
+					return
+				}
+			case <-timeout:
+				t.Fatalf("node-2 is not %v", typ)
+			}
+		}
+	}
+
+	// node-2 is still reachable by the indirect probes through node-1, only node-0 suspects it
+	c.Partition([]int{0}, []int{2})
+	wait(gossip.MemberSuspect)
+	c.Heal()
+	wait(gossip.MemberRefute)
+
+	if err := c.WaitConverged(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	var suspects, refutes uint64
+	for _, srv := range c.Servers {
+		var st = srv.Stats()
+		suspects, refutes = suspects+st.Suspects, refutes+st.Refutes
+	}
+	if suspects == 0 || refutes == 0 {
+		t.Errorf("suspicion should be counted, %d suspects, %d refutes", suspects, refutes)
+	}
+}
+
+// clusterCase 在收敛后的集群上检查一项功能
+type clusterCase struct {
+	name string
+	n    int
+	// setup 可选，在启动前调用，处理函数等需要与check共享状态的在check中注册
+	setup func(i int, srv *gossip.Server)
+	// converged 需要等待收敛的节点，为空时等待全部节点
+	converged []int
+	check     func(t *testing.T, c *Cluster)
+}
+
+var clusterCases = []clusterCase{
+	{
+		name: "key rotation",
+		n:    3,
+		setup: func(i int, srv *gossip.Server) {
+			srv.Config.SecretKey = gossip.DeriveKey("old")
+			srv.RemoteKeyring = i != 2
+		},
+		check: func(t *testing.T, c *Cluster) {
+			// keys of node-2 can not be managed remotely until it's enabled
+			var probe = c.Servers[0].Keyring().InstallCluster(c.ctx, "new")
+			if len(probe.Failed) != 1 || probe.Failed["node-2"] != gossip.ErrUnknownMethod {
+				t.Fatalf("only node-2 should fail, got %v", probe.Failed)
+			}
+			var ctx, cancel = c.ctx.WithTimeout(time.Second)
+			var err = c.Servers[2].Stop(ctx)
+			cancel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Servers[2].RemoteKeyring = true
+			if _, err := c.Servers[2].Rejoin(c.ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.WaitConverged(5 * time.Second); err != nil {
+				t.Fatal(err)
+			}
+
+			var result, rerr = c.Servers[0].Keyring().Rotate(c.ctx, "new", "old")
+			if rerr != nil {
+				t.Fatal(rerr, result.Failed)
+			}
+			if len(result.Acked) != 3 {
+				t.Errorf("all nodes should acknowledge, got %v", result.Acked)
+			}
+			for i, srv := range c.Servers {
+				var keys = srv.Keyring().Keys()
+				if len(keys) != 1 || string(keys[0]) != string(gossip.DeriveKey("new")) {
+					t.Errorf("node %d should only have the new key", i)
+				}
+			}
+
+			// the cluster still works with the new key
+			c.Servers[1].KV().Set("after", []byte("rotation"))
+			err = c.WaitFor(5*time.Second, func() bool {
+				var _, ok = c.Servers[2].KV().Get("after")
+				return ok
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		},
+	},
+	{
+		name: "segment",
+		n:    3,
+		setup: func(i int, srv *gossip.Server) {
+			srv.Segment.Cluster = "production"
+			if i == 2 {
+				srv.Segment.Cluster = "staging"
+			}
+		},
+		converged: []int{0, 1},
+		check: func(t *testing.T, c *Cluster) {
+			var err = c.WaitFor(5*time.Second, func() bool {
+				return c.Servers[0].Rejected() > 0 && c.Servers[2].Rejected() > 0
+			})
+			if err != nil {
+				t.Fatal("rejection should be counted")
+			}
+			if c.Servers[0].Peer("node-2") != nil || c.Servers[2].Peer("node-0") != nil {
+				t.Error("different segments should not join each other")
+			}
+		},
+	},
+	{
+		name: "name conflict",
+		n:    3,
+		setup: func(i int, srv *gossip.Server) {
+			srv.ConflictPolicy = gossip.ConflictRename
+		},
+		check: func(t *testing.T, c *Cluster) {
+			var events = []<-chan gossip.MemberEvent{
+				c.Servers[0].SubscribeMembers(c.ctx, 0),
+				c.Servers[2].SubscribeMembers(c.ctx, 0),
+			}
+			// node-1 restarts as node-2, it is newer but has the smaller address
+			var err = c.Restart(1, func(i int, srv *gossip.Server) {
+				srv.ConflictPolicy = gossip.ConflictRename
+				srv.Config.Name = "node-2"
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.WaitFor(10*time.Second, func() bool {
+				for _, srv := range c.Servers {
+					if len(srv.Peers()) != 3 || srv.Peer(c.Servers[1].Name()) == nil {
+						return false
+					}
+				}
+				return true
+			})
+			if err != nil {
+				t.Fatal("the newer node should rejoin under a derived name")
+			}
+			if name := c.Servers[2].Name(); name != "node-2" {
+				t.Errorf("the older node should keep its name, got %q", name)
+			}
+			if name := c.Servers[1].Name(); !strings.HasPrefix(name, "node-2-") {
+				t.Errorf("unexpected derived name %q", name)
+			}
+			if name := c.Servers[1].Config.Name; name != "node-2" {
+				t.Errorf("config should not be changed, got %q", name)
+			}
+
+			var conflicted = false
+			for _, ch := range events {
+			drain:
+				for {
+					select {
+					case ev := <-ch:
+						if ev.Type == gossip.MemberConflict && ev.Other != nil && ev.Node.Address() != ev.Other.Address() {
+							conflicted = true
+						}
+					case <-time.After(100 * time.Millisecond):
+						break drain
+					}
+				}
+			}
+			if !conflicted {
+				t.Error("conflict should be reported")
+			}
+		},
+	},
+	{
+		name: "coordinates",
+		n:    3,
+		check: func(t *testing.T, c *Cluster) {
+			// coordinates are exchanged by ping
+			var err = c.WaitFor(5*time.Second, func() bool {
+				var _, ok = c.Servers[0].EstimateRTT("node-1", "node-2")
+				return ok
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		},
+	},
+	{
+		name: "restart",
+		n:    3,
+		check: func(t *testing.T, c *Cluster) {
+			var srv = c.Servers[2]
+			if st := srv.State(); st != gossip.StateRunning {
+				t.Fatalf("unexpected state %s", st)
+			}
+			if err := srv.Start(c.ctx); !errors.Is(err, gossip.ErrServing) {
+				t.Fatalf("start twice should fail, got %v", err)
+			}
+
+			var ctx, cancel = c.ctx.WithTimeout(200 * time.Millisecond)
+			var err = srv.Stop(ctx)
+			cancel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st := srv.State(); st != gossip.StateStopped {
+				t.Fatalf("unexpected state %s", st)
+			}
+			select {
+			case <-srv.Ready():
+				t.Fatal("ready of the next run should not be closed")
+			default:
+			}
+			if err := c.WaitConverged(5*time.Second, 0, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := srv.Rejoin(c.ctx); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-srv.Ready():
+			default:
+				t.Fatal("ready should be closed once started")
+			}
+			if err := c.WaitConverged(5 * time.Second); err != nil {
+				t.Fatal(err)
+			}
+		},
+	},
+	{
+		name: "user events",
+		n:    3,
+		check: func(t *testing.T, c *Cluster) {
+			var received = make([]chan *gossip.UserEvent, len(c.Servers))
+			for i, srv := range c.Servers {
+				var ch = make(chan *gossip.UserEvent, 8)
+				received[i] = ch
+				srv.HandleEvent("deploy", 0, func(ctx context.Context, ev *gossip.UserEvent) { ch <- ev })
+			}
+			if err := c.Servers[0].FireEvent("deploy", []byte("v1")); err != nil {
+				t.Fatal(err)
+			}
+			for i, ch := range received {
+				select {
+				case ev := <-ch:
+					if ev.From != "node-0" || string(ev.Payload) != "v1" {
+						t.Errorf("node-%d received unexpected event %+v", i, ev)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("node-%d did not receive the event", i)
+				}
+			}
+			// rebroadcasts must not be delivered twice
+			time.Sleep(300 * time.Millisecond)
+			for i, ch := range received {
+				if len(ch) != 0 {
+					t.Errorf("node-%d received duplicated event", i)
+				}
+			}
+			if c.Servers[1].EventTime() == 0 {
+				t.Error("lamport clock should be advanced by received events")
+			}
+		},
+	},
+	{
+		name: "user events after restart",
+		n:    2,
+		check: func(t *testing.T, c *Cluster) {
+			var received = make(chan *gossip.UserEvent, 8)
+			c.Servers[0].HandleEvent("", 0, func(ctx context.Context, ev *gossip.UserEvent) { received <- ev })
+			var expect = func(name string) {
+				t.Helper()
+				select {
+				case ev := <-received:
+					if ev.Name != name || ev.From != "node-1" {
+						t.Errorf("unexpected event %s from %s", ev.Name, ev.From)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("event %s is not received", name)
+				}
+			}
+			if err := c.Servers[1].FireEvent("before", nil); err != nil {
+				t.Fatal(err)
+			}
+			expect("before")
+
+			// the restarted node catches up the clock by push/pull, its events are not taken as duplicated
+			if err := c.Restart(1, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.WaitConverged(5 * time.Second); err != nil {
+				t.Fatal(err)
+			}
+			if c.Servers[1].EventTime() < c.Servers[0].EventTime() {
+				t.Errorf("clock should be exchanged, %d < %d", c.Servers[1].EventTime(), c.Servers[0].EventTime())
+			}
+			if err := c.Servers[1].FireEvent("after", nil); err != nil {
+				t.Fatal(err)
+			}
+			expect("after")
+		},
+	},
+	{
+		name: "query",
+		n:    3,
+		setup: func(i int, srv *gossip.Server) {
+			if i == 0 {
+				return
+			}
+			srv.SetTags(gossip.Tags{gossip.TagRole: "api"})
+			srv.RegisterQuery("load", func(ctx context.Context, from string, payload []byte) ([]byte, error) {
+				if i == 2 {
+					// too slow to answer
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}
+				return []byte("low"), nil
+			})
+		},
+		check: func(t *testing.T, c *Cluster) {
+			var ctx, cancel = c.ctx.WithTimeout(time.Second)
+			defer cancel()
+			var r, err = c.Servers[0].Query(ctx, "load", nil, gossip.WithRole("api"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r.Targets) != 2 || len(r.Responses) != 1 || r.Responses[0].From != "node-1" || string(r.Responses[0].Payload) != "low" {
+				t.Errorf("unexpected result %+v", r)
+			}
+			if len(r.Acks) != 2 {
+				t.Errorf("both targets should ack, got %v", r.Acks)
+			}
+			if len(r.NoResponse) != 1 || r.NoResponse[0] != "node-2" {
+				t.Errorf("unexpected non-responders %v", r.NoResponse)
+			}
+
+			// queries of the restarted origin are not taken as the ones seen before
+			var query = func() {
+				t.Helper()
+				var ctx, cancel = c.ctx.WithTimeout(10 * time.Second)
+				defer cancel()
+				var r, err = c.Servers[0].Query(ctx, "load", nil, gossip.WithoutNames("node-2"))
+				if err != nil || len(r.NoResponse) != 0 {
+					t.Fatalf("unexpected result %+v, %v", r, err)
+				}
+			}
+			query()
+			if err := c.Restart(0, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.WaitConverged(5 * time.Second); err != nil {
+				t.Fatal(err)
+			}
+			query()
+		},
+	},
+	{
+		name: "stream",
+		n:    2,
+		check: func(t *testing.T, c *Cluster) {
+			var got = make(chan []byte, 1)
+			c.Servers[1].HandleStream("bundle", func(ctx context.Context, from string, r io.Reader) error {
+				var buf, err = ioutil.ReadAll(r)
+				got <- buf
+				return err
+			})
+			var payload = make([]byte, 1<<20)
+			rand.Read(payload)
+			var progress []int64
+			var n, err = c.Servers[0].SendStream(c.ctx, "node-1", "bundle", bytes.NewReader(payload), func(acked int64) {
+				progress = append(progress, acked)
+			})
+			if err != nil || n != int64(len(payload)) {
+				t.Fatalf("unexpected result %d, %v", n, err)
+			}
+			if buf := <-got; !bytes.Equal(buf, payload) {
+				t.Errorf("payload mismatch, %d bytes received", len(buf))
+			}
+			if len(progress) < 2 || progress[len(progress)-1] != n {
+				t.Errorf("unexpected progress %v", progress)
+			}
+
+			// streams of the restarted sender are not taken as the finished ones
+			if err := c.Restart(0, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.WaitConverged(5 * time.Second); err != nil {
+				t.Fatal(err)
+			}
+			rand.Read(payload)
+			n, err = c.Servers[0].SendStream(c.ctx, "node-1", "bundle", bytes.NewReader(payload), nil)
+			if err != nil || n != int64(len(payload)) {
+				t.Fatalf("unexpected result %d, %v", n, err)
+			}
+			select {
+			case buf := <-got:
+				if !bytes.Equal(buf, payload) {
+					t.Errorf("payload mismatch after restart, %d bytes received", len(buf))
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("stream of the restarted sender is not delivered")
+			}
+		},
+	},
+}
+
+func TestClusterFeatures(t *testing.T) {
+	for _, tc := range clusterCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var c, err = NewCluster(tc.n, tc.setup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Shutdown()
+
+			if err := c.WaitConverged(5*time.Second, tc.converged...); err != nil {
+				t.Fatal(err)
+			}
+			tc.check(t, c)
+		})
+	}
+}
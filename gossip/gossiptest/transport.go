@@ -0,0 +1,205 @@
+package gossiptest
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Network is an in-memory network, transports created by it can talk to each other.
+// Packet loss, latency and partitions could be injected at runtime.
+type Network struct {
+	mu         sync.RWMutex
+	transports map[string]*Transport
+	loss       float64
+	latency    time.Duration
+	// key<addr> => value<group>，不同分组之间的节点互不连通，未分组的节点与所有节点连通
+	partitions map[string]int
+}
+
+// NewNetwork return an empty in-memory network
+func NewNetwork() *Network {
+	return &Network{
+		transports: make(map[string]*Transport),
+		partitions: make(map[string]int),
+	}
+}
+
+// NewTransport create a transport bound to the given address, e.g. 127.0.0.1:7946
+func (n *Network) NewTransport(addr string) (*Transport, error) {
+	var udpaddr, err = net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	addr = udpaddr.String()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.transports[addr]; ok {
+		return nil, fmt.Errorf("address %s already in use", addr)
+	}
+	var t = &Transport{
+		net:      n,
+		addr:     udpaddr,
+		packetCh: make(chan *memberlist.Packet, 1024),
+		streamCh: make(chan net.Conn),
+		shutsig:  make(chan struct{}),
+	}
+	n.transports[addr] = t
+	return t, nil
+}
+
+// SetLoss set the packet loss rate in [0, 1], streams are never lost
+func (n *Network) SetLoss(rate float64) {
+	n.mu.Lock()
+	n.loss = rate
+	n.mu.Unlock()
+}
+
+// SetLatency set the one-way latency of packets and stream dialing
+func (n *Network) SetLatency(d time.Duration) {
+	n.mu.Lock()
+	n.latency = d
+	n.mu.Unlock()
+}
+
+// Partition split the network into the given groups of addresses,
+// addresses in different groups can not reach each other
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partitions = make(map[string]int)
+	for i, g := range groups {
+		for _, addr := range g {
+			n.partitions[addr] = i + 1
+		}
+	}
+}
+
+// Heal remove all partitions
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+// route 查找目的transport，返回nil表示不可达
+func (n *Network) route(from, to string) (*Transport, time.Duration, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	var dest = n.transports[to]
+	if dest == nil {
+		return nil, 0, false
+	}
+	var gf, gt = n.partitions[from], n.partitions[to]
+	if gf != 0 && gt != 0 && gf != gt {
+		return nil, 0, false
+	}
+	var lost = n.loss > 0 && rand.Float64() < n.loss
+	return dest, n.latency, lost
+}
+
+func (n *Network) remove(t *Transport) {
+	n.mu.Lock()
+	if n.transports[t.addr.String()] == t {
+		delete(n.transports, t.addr.String())
+	}
+	n.mu.Unlock()
+}
+
+// Transport is an in-memory memberlist.Transport
+type Transport struct {
+	net  *Network
+	addr *net.UDPAddr
+
+	packetCh chan *memberlist.Packet
+	streamCh chan net.Conn
+
+	once    sync.Once
+	shutsig chan struct{}
+}
+
+var _ memberlist.Transport = &Transport{}
+
+// Addr return the bound address
+func (t *Transport) Addr() string {
+	return t.addr.String()
+}
+
+// FinalAdvertiseAddr always use the bound address
+func (t *Transport) FinalAdvertiseAddr(ip string, port int) (net.IP, int, error) {
+	return t.addr.IP, t.addr.Port, nil
+}
+
+// WriteTo deliver the packet, unreachable or lost packet is dropped silently like udp,
+// and so is the packet to a slow node whose receive queue is full, it never blocks the sender
+func (t *Transport) WriteTo(b []byte, addr string) (time.Time, error) {
+	var now = time.Now()
+	var dest, latency, lost = t.net.route(t.Addr(), addr)
+	if dest == nil || lost {
+		return now, nil
+	}
+	var p = &memberlist.Packet{
+		Buf:  append([]byte(nil), b...),
+		From: t.addr,
+	}
+	var deliver = func() {
+		p.Timestamp = time.Now()
+		select {
+		case dest.packetCh <- p:
+		default:
+		}
+	}
+	if latency > 0 {
+		time.AfterFunc(latency, deliver)
+	} else {
+		deliver()
+	}
+	return now, nil
+}
+
+// PacketCh return the channel of received packets
+func (t *Transport) PacketCh() <-chan *memberlist.Packet {
+	return t.packetCh
+}
+
+// DialTimeout connect to the destination by net.Pipe
+func (t *Transport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	var dest, latency, _ = t.net.route(t.Addr(), addr)
+	if dest == nil {
+		return nil, fmt.Errorf("no route to %s", addr)
+	}
+	if latency > 0 {
+		if latency > timeout {
+			time.Sleep(timeout)
+			return nil, fmt.Errorf("dial %s timeout", addr)
+		}
+		time.Sleep(latency)
+	}
+
+	var local, remote = net.Pipe()
+	select {
+	case dest.streamCh <- remote:
+		return local, nil
+	case <-dest.shutsig:
+		return nil, fmt.Errorf("connection refused by %s", addr)
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("dial %s timeout", addr)
+	}
+}
+
+// StreamCh return the channel of accepted streams
+func (t *Transport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// Shutdown detach the transport from network
+func (t *Transport) Shutdown() error {
+	t.once.Do(func() {
+		t.net.remove(t)
+		close(t.shutsig)
+	})
+	return nil
+}
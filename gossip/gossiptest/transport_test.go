@@ -0,0 +1,37 @@
+package gossiptest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransportSlowReceiver(t *testing.T) {
+	var n = NewNetwork()
+	var a, err = n.NewTransport("127.0.0.1:10000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := n.NewTransport("127.0.0.1:10001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Shutdown()
+	defer b.Shutdown()
+
+	// b never reads, the packets beyond its queue are dropped instead of blocking a
+	var done = make(chan struct{})
+	go func() {
+		for i := 0; i < 2*cap(b.packetCh); i++ {
+			a.WriteTo([]byte("x"), b.Addr())
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sender should not be blocked by slow receiver")
+	}
+	if l := len(b.PacketCh()); l != cap(b.packetCh) {
+		t.Errorf("receive queue should be full, got %d", l)
+	}
+}
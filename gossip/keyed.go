@@ -0,0 +1,219 @@
+package gossip
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// KeyedMessageDelegate is an optional interface of Delegate,
+// if implemented, keyed broadcasts will be delivered to it instead of NotifyMessage
+type KeyedMessageDelegate interface {
+	// NotifyKeyedMessage notify received keyed message, stale ones are dropped already
+	NotifyKeyedMessage(from, key string, version uint64, msg []byte)
+}
+
+// BroadcastResult is the reason a keyed broadcast left the queue
+type BroadcastResult int
+
+const (
+	// BroadcastTransmitted means the broadcast was retransmitted enough times
+	BroadcastTransmitted BroadcastResult = iota
+	// BroadcastInvalidated means the broadcast was superseded by a newer one with the same key
+	BroadcastInvalidated
+	// BroadcastDropped means the broadcast was dropped because its lane is full
+	BroadcastDropped
+)
+
+func (r BroadcastResult) String() string {
+	switch r {
+	case BroadcastTransmitted:
+		return "transmitted"
+	case BroadcastInvalidated:
+		return "invalidated"
+	case BroadcastDropped:
+		return "dropped"
+	}
+	return "unknown"
+}
+
+// BroadcastFinished is called when a keyed broadcast leaves the queue
+type BroadcastFinished func(result BroadcastResult)
+
+type keyedBroadcast struct {
+	key      string
+	msg      []byte
+	finished BroadcastFinished
+
+	mu          sync.Mutex
+	invalidated bool
+}
+
+func (b *keyedBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	if o, ok := other.(*keyedBroadcast); ok && o.key == b.key {
+		o.mu.Lock()
+		o.invalidated = true
+		o.mu.Unlock()
+		return true
+	}
+	return false
+}
+
+func (b *keyedBroadcast) Message() []byte {
+	return b.msg
+}
+
+func (b *keyedBroadcast) Finished() {
+	if b.finished == nil {
+		return
+	}
+	b.mu.Lock()
+	var invalidated = b.invalidated
+	b.mu.Unlock()
+	if invalidated {
+		b.finished(BroadcastInvalidated)
+	} else {
+		b.finished(BroadcastTransmitted)
+	}
+}
+
+func (b *keyedBroadcast) dropped() {
+	if b.finished != nil {
+		b.finished(BroadcastDropped)
+	}
+}
+
+// 消息格式：
+// uvarint(len(from)) | from | uvarint(len(key)) | key | uvarint(version) | msg
+func encodeKeyedMessage(from, key string, version uint64, msg []byte) []byte {
+	var buf = make([]byte, 0, 3*binary.MaxVarintLen64+len(from)+len(key)+len(msg))
+	buf = appendString(buf, from)
+	buf = appendString(buf, key)
+	buf = appendUvarint(buf, version)
+	return append(buf, msg...)
+}
+
+func decodeKeyedMessage(buf []byte) (from, key string, version uint64, msg []byte, err error) {
+	if from, buf, err = readString(buf); err != nil {
+		return
+	}
+	if key, buf, err = readString(buf); err != nil {
+		return
+	}
+	if version, buf, err = readUvarint(buf); err != nil {
+		return
+	}
+	msg = buf
+	return
+}
+
+// KeyedTombstoneTTL is how long the versions of a left node are remembered,
+// stale broadcasts of the node received after it rejoined in this period are still dropped
+var KeyedTombstoneTTL = 10 * time.Minute
+
+// keyedPeer 某个节点每个key已经见过的最大版本号
+type keyedPeer struct {
+	// key<key> => value<version>
+	versions map[string]uint64
+	// 节点离开的时间，离开后保留一段时间作为墓碑
+	left time.Time
+}
+
+// keyedVersions 记录每个(节点, key)已经见过的最大版本号
+type keyedVersions struct {
+	mu sync.Mutex
+	// 发送方向，key<key> => value<本地生成或者见过的最大版本号>
+	local map[string]uint64
+	// 接收方向，key<node name> => value<versions>
+	remote map[string]*keyedPeer
+}
+
+func newKeyedVersions() *keyedVersions {
+	return &keyedVersions{
+		local:  make(map[string]uint64),
+		remote: make(map[string]*keyedPeer),
+	}
+}
+
+// next 生成本地的下一个版本号，类似混合逻辑时钟：至少比本地生成过的和从其他节点见过的都大，
+// 因此与节点间的时钟偏差无关，以纳秒时间戳为下限，保证进程重启后依然递增
+func (v *keyedVersions) next(key string) uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var ver = uint64(time.Now().UnixNano())
+	if last := v.local[key]; ver <= last {
+		ver = last + 1
+	}
+	v.local[key] = ver
+	return ver
+}
+
+// accept 判断收到的版本是否比已知的新，新则记录下来
+func (v *keyedVersions) accept(from, key string, version uint64) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var peer = v.remote[from]
+	if peer == nil {
+		peer = &keyedPeer{versions: make(map[string]uint64)}
+		v.remote[from] = peer
+	}
+	if version <= peer.versions[key] {
+		return false
+	}
+	peer.versions[key] = version
+	peer.left = time.Time{}
+	if version > v.local[key] {
+		v.local[key] = version
+	}
+	return true
+}
+
+// forget 节点离开后只标记为墓碑，重新加入后仍在传播的旧广播依然会被丢弃，过期的墓碑才会被清理
+func (v *keyedVersions) forget(from string) {
+	var now = time.Now()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for name, peer := range v.remote {
+		if !peer.left.IsZero() && now.Sub(peer.left) > KeyedTombstoneTTL {
+			delete(v.remote, name)
+		}
+	}
+	if peer := v.remote[from]; peer != nil {
+		peer.left = now
+	}
+}
+
+// BroadcastKeyed broadcast the msg with a key, a newer broadcast with the same key
+// invalidates the queued older one, and receivers drop the stale ones.
+// finished is optional.
+func (s *Sender) BroadcastKeyed(key string, msg []byte, finished BroadcastFinished) {
+	if s == nil {
+		return
+	}
+	var ver = s.srv.keyed.next(key)
+	s.queueBroadcast(PriorityNormal, &keyedBroadcast{
+		key:      key,
+		msg:      encodeMessage(kindKeyed, encodeKeyedMessage(s.srv.localName(), key, ver, msg)),
+		finished: finished,
+	})
+}
+
+func (d *delegateM) notifyKeyedMessage(msg []byte) {
+	var from, key, ver, body, err = decodeKeyedMessage(msg)
+	if err != nil {
+		return
+	}
+	if !d.srv.keyed.accept(from, key, ver) {
+		return
+	}
+	if d.dg == nil {
+		return
+	}
+	if kd, ok := d.dg.(KeyedMessageDelegate); ok {
+		kd.NotifyKeyedMessage(from, key, ver, body)
+	} else {
+		d.dg.NotifyMessage(body)
+	}
+}
@@ -0,0 +1,71 @@
+package gossip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func TestKeyedBroadcastInvalidates(t *testing.T) {
+	var queue = &memberlist.TransmitLimitedQueue{
+		NumNodes:       func() int { return 1 },
+		RetransmitMult: 1,
+	}
+	var results []BroadcastResult
+	var finished = func(result BroadcastResult) {
+		results = append(results, result)
+	}
+	queue.QueueBroadcast(&keyedBroadcast{key: "status", msg: []byte("busy"), finished: finished})
+	queue.QueueBroadcast(&keyedBroadcast{key: "other", msg: []byte("x")})
+	queue.QueueBroadcast(&keyedBroadcast{key: "status", msg: []byte("idle"), finished: finished})
+
+	if n := queue.NumQueued(); n != 2 {
+		t.Errorf("expect 2 queued broadcasts, got %d", n)
+	}
+	if len(results) != 1 || results[0] != BroadcastInvalidated {
+		t.Errorf("older broadcast should be finished as invalidated, got %v", results)
+	}
+}
+
+func TestKeyedVersions(t *testing.T) {
+	var v = newKeyedVersions()
+	var v1 = v.next("k")
+	var v2 = v.next("k")
+	if v2 <= v1 {
+		t.Fatalf("version should increase, %d => %d", v1, v2)
+	}
+
+	var from, key, ver, msg, err = decodeKeyedMessage(encodeKeyedMessage("a", "k", v2, []byte("idle")))
+	if err != nil || from != "a" || key != "k" || ver != v2 || string(msg) != "idle" {
+		t.Fatalf("decode mismatch: %s %s %d %q %v", from, key, ver, msg, err)
+	}
+
+	if !v.accept("a", "k", v2) {
+		t.Error("newer version should be accepted")
+	}
+	if v.accept("a", "k", v1) {
+		t.Error("stale version should be dropped")
+	}
+	if !v.accept("b", "k", v1) {
+		t.Error("versions of different nodes are independent")
+	}
+
+	// versions seen from others are witnessed, local clock skew does not matter
+	var ahead = uint64(time.Now().Add(time.Hour).UnixNano())
+	v.accept("c", "k", ahead)
+	if ver := v.next("k"); ver <= ahead {
+		t.Errorf("local version %d should be after witnessed %d", ver, ahead)
+	}
+
+	// stale broadcasts of a rejoined node are still dropped
+	v.forget("a")
+	if v.accept("a", "k", v2) {
+		t.Error("stale version of left node should be dropped")
+	}
+	v.remote["a"].left = time.Now().Add(-2 * KeyedTombstoneTTL)
+	v.forget("b")
+	if _, ok := v.remote["a"]; ok {
+		t.Error("expired tombstone should be removed")
+	}
+}
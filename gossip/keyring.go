@@ -0,0 +1,222 @@
+package gossip
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+
+	"github.com/cjey/gbase/context"
+)
+
+// ErrEncryptionDisabled means the server is created without key
+var ErrEncryptionDisabled = errors.New("encryption disabled")
+
+const (
+	_RPC_KEYRING_INSTALL = "gossip.keyring.install"
+	_RPC_KEYRING_USE     = "gossip.keyring.use"
+	_RPC_KEYRING_REMOVE  = "gossip.keyring.remove"
+)
+
+// DeriveKey derive the AES-128 key from the given passphrase, same as NewServer
+func DeriveKey(key string) []byte {
+	var hashed = sha1.Sum([]byte("magic=Chaos Is A Ladder&" + key))
+	return hashed[:16]
+}
+
+// KeyResult is the result of a cluster-wide keyring operation
+type KeyResult struct {
+	// Acked is the nodes applied the operation, include local node
+	Acked []string
+	// Failed is the nodes failed to apply the operation
+	Failed map[string]error
+}
+
+// OK return true if all nodes acknowledged
+func (r *KeyResult) OK() bool {
+	return len(r.Failed) == 0
+}
+
+// Keyring manage the encryption keys of server at runtime
+type Keyring struct {
+	srv *Server
+	// 不使用s.mu，停止时它可能被持有很久
+	mu sync.Mutex
+	// 首次使用时由Config中的Keyring或者SecretKey初始化，之后以它为准，Config保持用户的原始配置
+	kr *memberlist.Keyring
+	// 只注册一次rpc
+	remote sync.Once
+}
+
+func newKeyring(srv *Server) *Keyring {
+	return &Keyring{srv: srv}
+}
+
+// acceptRemote 注册rpc，允许其他节点通过InstallCluster等管理本节点的密钥
+func (k *Keyring) acceptRemote() {
+	k.remote.Do(func() {
+		var rpc = k.srv.RPC()
+		rpc.Register(_RPC_KEYRING_INSTALL, k.handler(k.install))
+		rpc.Register(_RPC_KEYRING_USE, k.handler(k.use))
+		rpc.Register(_RPC_KEYRING_REMOVE, k.handler(k.remove))
+	})
+}
+
+// Keyring return the keyring manager of server
+func (s *Server) Keyring() *Keyring {
+	return s.keyring
+}
+
+// keyring 返回memberlist使用的keyring，与memberlist相同，同时配置时SecretKey作为Keyring的主密钥，
+// 密钥复制到新的keyring中，运行时的修改不会影响用户配置的Keyring
+func (k *Keyring) keyring() (*memberlist.Keyring, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.kr != nil {
+		return k.kr, nil
+	}
+	var cfg = k.srv.Config
+	var keys [][]byte
+	var primary = cfg.SecretKey
+	if cfg.Keyring != nil {
+		keys = cfg.Keyring.GetKeys()
+		if len(primary) == 0 && len(keys) > 0 {
+			primary = keys[0]
+		}
+	}
+	if len(primary) == 0 {
+		return nil, ErrEncryptionDisabled
+	}
+	var kr, err = memberlist.NewKeyring(keys, primary)
+	if err != nil {
+		return nil, err
+	}
+	k.kr = kr
+	return k.kr, nil
+}
+
+// Keys return all installed keys, the primary key is the first one
+func (k *Keyring) Keys() [][]byte {
+	var kr, err = k.keyring()
+	if err != nil {
+		return nil
+	}
+	return kr.GetKeys()
+}
+
+// Install install the key derived from passphrase on local node,
+// it could be used for decryption, but not for encryption
+func (k *Keyring) Install(key string) error {
+	return k.install(DeriveKey(key))
+}
+
+// Use make the key derived from passphrase as primary key on local node, it must be installed already
+func (k *Keyring) Use(key string) error {
+	return k.use(DeriveKey(key))
+}
+
+// Remove remove the key derived from passphrase on local node, primary key can not be removed
+func (k *Keyring) Remove(key string) error {
+	return k.remove(DeriveKey(key))
+}
+
+func (k *Keyring) install(key []byte) error {
+	var kr, err = k.keyring()
+	if err != nil {
+		return err
+	}
+	return kr.AddKey(key)
+}
+
+func (k *Keyring) use(key []byte) error {
+	var kr, err = k.keyring()
+	if err != nil {
+		return err
+	}
+	return kr.UseKey(key)
+}
+
+func (k *Keyring) remove(key []byte) error {
+	var kr, err = k.keyring()
+	if err != nil {
+		return err
+	}
+	return kr.RemoveKey(key)
+}
+
+func (k *Keyring) handler(op func([]byte) error) RPCHandler {
+	return func(ctx context.Context, from string, req []byte) ([]byte, error) {
+		return nil, op(req)
+	}
+}
+
+// InstallCluster install the key on all nodes, the nodes without Server.RemoteKeyring enabled fail
+func (k *Keyring) InstallCluster(ctx context.Context, key string) *KeyResult {
+	return k.cluster(ctx, _RPC_KEYRING_INSTALL, k.install, DeriveKey(key))
+}
+
+// UseCluster make the key as primary key on all nodes, it must be installed on all nodes already
+func (k *Keyring) UseCluster(ctx context.Context, key string) *KeyResult {
+	return k.cluster(ctx, _RPC_KEYRING_USE, k.use, DeriveKey(key))
+}
+
+// RemoveCluster remove the key on all nodes
+func (k *Keyring) RemoveCluster(ctx context.Context, key string) *KeyResult {
+	return k.cluster(ctx, _RPC_KEYRING_REMOVE, k.remove, DeriveKey(key))
+}
+
+// Rotate replace the old key by the new key in the whole cluster,
+// it installs the new key, switches primary key, and removes the old key step by step,
+// the next step will not start until all nodes acknowledged the previous step.
+func (k *Keyring) Rotate(ctx context.Context, newKey, oldKey string) (*KeyResult, error) {
+	var steps = []struct {
+		name string
+		op   func(context.Context, string) *KeyResult
+		key  string
+	}{
+		{"install", k.InstallCluster, newKey},
+		{"use", k.UseCluster, newKey},
+		{"remove", k.RemoveCluster, oldKey},
+	}
+	var result *KeyResult
+	for _, step := range steps {
+		result = step.op(ctx, step.key)
+		if !result.OK() {
+			return result, fmt.Errorf("key rotation aborted at %s step, %d nodes failed", step.name, len(result.Failed))
+		}
+	}
+	return result, nil
+}
+
+// cluster 先在本地执行，然后通过加密的可靠通道并发通知其他所有节点
+func (k *Keyring) cluster(ctx context.Context, method string, local func([]byte) error, key []byte) *KeyResult {
+	var result = &KeyResult{Failed: make(map[string]error)}
+	if err := local(key); err != nil {
+		result.Failed[k.srv.localName()] = err
+	} else {
+		result.Acked = append(result.Acked, k.srv.localName())
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range k.srv.Others() {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			var _, err = k.srv.RPC().Call(ctx, name, method, key)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				result.Failed[name] = err
+			} else {
+				result.Acked = append(result.Acked, name)
+			}
+		}(peer.Name)
+	}
+	wg.Wait()
+	sort.Strings(result.Acked)
+	return result
+}
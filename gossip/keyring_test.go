@@ -0,0 +1,38 @@
+package gossip
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func TestKeyringCopyConfig(t *testing.T) {
+	var srv = NewServer("a", "secret")
+	var a, b = DeriveKey("a"), DeriveKey("b")
+	var user, err = memberlist.NewKeyring([][]byte{b}, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Config.Keyring = user
+
+	// SecretKey is the primary key, same as memberlist
+	var keys = srv.Keyring().Keys()
+	if len(keys) != 3 || !bytes.Equal(keys[0], DeriveKey("secret")) {
+		t.Errorf("unexpected runtime keys %q", keys)
+	}
+	if err := srv.Keyring().Install("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Keyring().Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.Keyring().Keys()) != 3 {
+		t.Errorf("unexpected runtime keys %q", srv.Keyring().Keys())
+	}
+
+	// the keyring of config is not changed at runtime
+	if keys := user.GetKeys(); len(keys) != 2 || !bytes.Equal(keys[0], a) || !bytes.Equal(keys[1], b) {
+		t.Errorf("keyring of config should be untouched, got %q", keys)
+	}
+}
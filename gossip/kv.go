@@ -0,0 +1,238 @@
+package gossip
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// KVTombstoneTTL is how long a deleted key is remembered,
+// a node which is partitioned longer than this may resurrect the deleted key
+var KVTombstoneTTL = 24 * time.Hour
+
+// KVWatcher is called after a key was changed by local or remote write
+type KVWatcher func(key string, value []byte, deleted bool)
+
+type kvEntry struct {
+	Key     string `json:"k"`
+	Value   []byte `json:"v,omitempty"`
+	Version uint64 `json:"ver"`
+	Node    string `json:"n"`
+	Deleted bool   `json:"d,omitempty"`
+
+	deletedAt time.Time
+}
+
+// newer 判断e是否比o新，版本号大者胜出，版本号相同时以节点名大者胜出
+func (e *kvEntry) newer(o *kvEntry) bool {
+	if o == nil {
+		return true
+	}
+	if e.Version != o.Version {
+		return e.Version > o.Version
+	}
+	return e.Node > o.Node
+}
+
+type kvBroadcast struct {
+	key string
+	msg []byte
+}
+
+func (b *kvBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	if o, ok := other.(*kvBroadcast); ok {
+		return o.key == b.key
+	}
+	return false
+}
+
+func (b *kvBroadcast) Message() []byte {
+	return b.msg
+}
+
+func (b *kvBroadcast) Finished() {
+}
+
+// KV is a cluster-wide replicated last-writer-wins key/value store.
+// Local writes are broadcasted as deltas, and the full state is exchanged
+// by push/pull periodically, so every node converges eventually.
+type KV struct {
+	srv *Server
+
+	mu       sync.RWMutex
+	clock    uint64
+	entries  map[string]*kvEntry
+	watchers []KVWatcher
+}
+
+func newKV(srv *Server) *KV {
+	return &KV{
+		srv:     srv,
+		entries: make(map[string]*kvEntry),
+	}
+}
+
+// Get return the value of key
+func (kv *KV) Get(key string) ([]byte, bool) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	var e = kv.entries[key]
+	if e == nil || e.Deleted {
+		return nil, false
+	}
+	// 返回副本，避免调用方修改存储的数据
+	var v = make([]byte, len(e.Value))
+	copy(v, e.Value)
+	return v, true
+}
+
+// Keys return all alive keys in order
+func (kv *KV) Keys() []string {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	var keys = make([]string, 0, len(kv.entries))
+	for k, e := range kv.entries {
+		if !e.Deleted {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Set write the value of key, and broadcast it to the cluster
+func (kv *KV) Set(key string, value []byte) {
+	var v = make([]byte, len(value))
+	copy(v, value)
+	kv.write(&kvEntry{Key: key, Value: v})
+}
+
+// Delete remove the key, and broadcast it to the cluster
+func (kv *KV) Delete(key string) {
+	kv.write(&kvEntry{Key: key, Deleted: true})
+}
+
+// Watch register a watcher, it will be called on every change
+func (kv *KV) Watch(w KVWatcher) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.watchers = append(kv.watchers, w)
+}
+
+func (kv *KV) write(e *kvEntry) {
+	kv.mu.Lock()
+	kv.clock++
+	e.Version = kv.clock
+	e.Node = kv.srv.localName()
+	kv.apply(e)
+	var watchers = kv.watchers
+	kv.mu.Unlock()
+
+	kv.broadcast(e)
+	kv.notify(watchers, e)
+}
+
+// apply 必须在持有锁的情况下调用，返回是否真正发生了变更
+func (kv *KV) apply(e *kvEntry) bool {
+	if e.Version > kv.clock {
+		kv.clock = e.Version
+	}
+	if !e.newer(kv.entries[e.Key]) {
+		return false
+	}
+	if e.Deleted {
+		e.Value = nil
+		e.deletedAt = time.Now()
+	}
+	kv.entries[e.Key] = e
+	return true
+}
+
+func (kv *KV) notify(watchers []KVWatcher, e *kvEntry) {
+	for _, w := range watchers {
+		w(e.Key, e.Value, e.Deleted)
+	}
+}
+
+func (kv *KV) broadcast(e *kvEntry) {
+	var sender = kv.srv.currentSender()
+	if sender == nil {
+		// 尚未启动，等待push/pull同步
+		return
+	}
+	var buf, err = json.Marshal(e)
+	if err != nil {
+		return
+	}
+	var msg = encodeMessage(kindKV, buf)
+	if !sender.fitsPacket(msg) {
+		// 放不进一个udp包，只能依赖push/pull同步
+		return
+	}
+	sender.queueBroadcast(PriorityNormal, &kvBroadcast{key: e.Key, msg: msg})
+}
+
+// merge 合并远端数据，并通知真正发生了变更的条目
+func (kv *KV) merge(entries []*kvEntry) {
+	var changed = make([]*kvEntry, 0)
+	kv.mu.Lock()
+	for _, e := range entries {
+		if e == nil || e.Key == "" {
+			continue
+		}
+		if kv.apply(e) {
+			changed = append(changed, e)
+		}
+	}
+	var watchers = kv.watchers
+	kv.mu.Unlock()
+
+	for _, e := range changed {
+		kv.notify(watchers, e)
+	}
+}
+
+func (kv *KV) notifyMessage(msg []byte) {
+	var e kvEntry
+	if err := json.Unmarshal(msg, &e); err != nil {
+		return
+	}
+	kv.merge([]*kvEntry{&e})
+}
+
+// localState 导出完整状态用于push/pull，顺便清理过期的墓碑
+func (kv *KV) localState() []byte {
+	kv.mu.Lock()
+	var entries = make([]*kvEntry, 0, len(kv.entries))
+	for k, e := range kv.entries {
+		if e.Deleted && time.Since(e.deletedAt) > KVTombstoneTTL {
+			delete(kv.entries, k)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	kv.mu.Unlock()
+
+	if len(entries) == 0 {
+		return nil
+	}
+	var buf, err = json.Marshal(entries)
+	if err != nil {
+		return nil
+	}
+	return buf
+}
+
+func (kv *KV) mergeRemoteState(buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+	var entries []*kvEntry
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		return
+	}
+	kv.merge(entries)
+}
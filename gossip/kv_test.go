@@ -0,0 +1,64 @@
+package gossip
+
+import (
+	"testing"
+)
+
+func TestKVConverge(t *testing.T) {
+	var a = NewServer("a", "").KV()
+	var b = NewServer("b", "").KV()
+
+	a.Set("x", []byte("1"))
+	b.Set("x", []byte("2"))
+	b.Set("y", []byte("3"))
+	a.Delete("y")
+
+	// exchange full state by push/pull
+	var sa, sb = a.localState(), b.localState()
+	a.mergeRemoteState(sb)
+	b.mergeRemoteState(sa)
+
+	for _, kv := range []*KV{a, b} {
+		if v, ok := kv.Get("x"); !ok || string(v) != "2" {
+			t.Errorf("x should be 2 on both side, got %q", v)
+		}
+		if v, ok := kv.Get("y"); !ok || string(v) != "3" {
+			t.Errorf("y should be 3 on both side, got %q", v)
+		}
+	}
+
+	// later delete wins
+	a.Delete("x")
+	b.mergeRemoteState(a.localState())
+	if _, ok := b.Get("x"); ok {
+		t.Error("x should be deleted")
+	}
+	if keys := b.Keys(); len(keys) != 1 || keys[0] != "y" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	// the returned value is a copy
+	var v, _ = b.Get("y")
+	v[0] = 'x'
+	if v, _ := b.Get("y"); string(v) != "3" {
+		t.Errorf("store should not be modified by caller, got %q", v)
+	}
+}
+
+func TestKVWatch(t *testing.T) {
+	var a = NewServer("a", "").KV()
+	var b = NewServer("b", "").KV()
+
+	var changes int
+	b.Watch(func(key string, value []byte, deleted bool) {
+		changes++
+	})
+
+	a.Set("x", []byte("1"))
+	var state = a.localState()
+	b.mergeRemoteState(state)
+	b.mergeRemoteState(state) // duplicated state is ignored
+	if changes != 1 {
+		t.Errorf("watcher should be called once, got %d", changes)
+	}
+}
@@ -0,0 +1,154 @@
+package gossip
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Priority of broadcast, lower value will be sent first
+type Priority int
+
+const (
+	// PriorityControl for small and important messages, e.g. membership related state
+	PriorityControl Priority = iota
+	// PriorityNormal is the default priority of Broadcast
+	PriorityNormal
+	// PriorityBulk for large or less important messages
+	PriorityBulk
+
+	_PRIORITY_NUM = iota
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityControl:
+		return "control"
+	case PriorityNormal:
+		return "normal"
+	case PriorityBulk:
+		return "bulk"
+	}
+	return "unknown"
+}
+
+// DropPolicy decide which broadcast to drop when the lane is full
+type DropPolicy int
+
+const (
+	// DropOldest discard the oldest queued broadcasts to make room for the new one
+	DropOldest DropPolicy = iota
+	// DropNewest discard the new broadcast
+	DropNewest
+)
+
+// LaneConfig is the config of a broadcast lane
+type LaneConfig struct {
+	// MaxDepth is the maximum number of queued broadcasts, 0 means unlimited
+	MaxDepth int
+	Policy   DropPolicy
+}
+
+// LaneStats is a snapshot of a broadcast lane
+type LaneStats struct {
+	Priority Priority
+	Queued   int
+	Dropped  uint64
+}
+
+type lane struct {
+	cfg   LaneConfig
+	queue *memberlist.TransmitLimitedQueue
+	// mu 串行化队列的所有操作，丢弃时的判断、裁剪和计数必须是原子的
+	mu sync.Mutex
+	// 正在裁剪队列，期间被结束的广播都是被丢弃的
+	pruning bool
+	dropped uint64
+}
+
+// droppable 由需要区分被丢弃和正常结束的广播实现，被通道丢弃时调用dropped而不是Finished
+type droppable interface {
+	dropped()
+}
+
+// laneBroadcast 包装入队的广播，以便识别memberlist在Prune中结束的广播
+type laneBroadcast struct {
+	memberlist.Broadcast
+	lane *lane
+}
+
+func (b *laneBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	if o, ok := other.(*laneBroadcast); ok {
+		other = o.Broadcast
+	}
+	return b.Broadcast.Invalidates(other)
+}
+
+// Finished 总是在持有lane.mu时被调用
+func (b *laneBroadcast) Finished() {
+	if b.lane.pruning {
+		b.lane.drop(b.Broadcast)
+		return
+	}
+	b.Broadcast.Finished()
+}
+
+func (l *lane) drop(b memberlist.Broadcast) {
+	atomic.AddUint64(&l.dropped, 1)
+	if d, ok := b.(droppable); ok {
+		d.dropped()
+	} else {
+		b.Finished()
+	}
+}
+
+func newLanes(srv *Server) []*lane {
+	var numNodes = func() int {
+		srv.pmu.RLock()
+		defer srv.pmu.RUnlock()
+		return len(srv.peers)
+	}
+	var lanes = make([]*lane, _PRIORITY_NUM)
+	for i := range lanes {
+		lanes[i] = &lane{
+			cfg: srv.Lanes[i],
+			queue: &memberlist.TransmitLimitedQueue{
+				NumNodes:       numNodes,
+				RetransmitMult: srv.Config.RetransmitMult,
+			},
+		}
+	}
+	return lanes
+}
+
+// push 按照丢弃策略入队，返回是否真正入队
+func (l *lane) push(b memberlist.Broadcast) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cfg.MaxDepth > 0 && l.cfg.Policy == DropNewest && l.queue.NumQueued() >= l.cfg.MaxDepth {
+		l.drop(b)
+		return false
+	}
+	l.queue.QueueBroadcast(&laneBroadcast{Broadcast: b, lane: l})
+	if l.cfg.MaxDepth > 0 && l.cfg.Policy == DropOldest && l.queue.NumQueued() > l.cfg.MaxDepth {
+		l.pruning = true
+		l.queue.Prune(l.cfg.MaxDepth)
+		l.pruning = false
+	}
+	return true
+}
+
+func (l *lane) pop(overhead, limit int) [][]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.queue.GetBroadcasts(overhead, limit)
+}
+
+func (l *lane) stats(p Priority) LaneStats {
+	return LaneStats{
+		Priority: p,
+		Queued:   l.queue.NumQueued(),
+		Dropped:  atomic.LoadUint64(&l.dropped),
+	}
+}
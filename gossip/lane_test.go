@@ -0,0 +1,92 @@
+package gossip
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestLaneDropPolicy(t *testing.T) {
+	var srv = NewServer("a", "")
+	srv.Lanes[PriorityNormal] = LaneConfig{MaxDepth: 2, Policy: DropOldest}
+	srv.Lanes[PriorityBulk] = LaneConfig{MaxDepth: 2, Policy: DropNewest}
+	var s = newSender(srv, nil)
+
+	for _, msg := range []string{"1", "2", "3"} {
+		s.BroadcastPriority(PriorityNormal, []byte(msg))
+	}
+	for _, msg := range []string{"1", "2", "3"} {
+		s.BroadcastPriority(PriorityBulk, []byte(msg))
+	}
+	if s.BroadcastPriority(PriorityBulk, []byte("4")) {
+		t.Error("full bulk lane should drop the newest")
+	}
+
+	var stats = s.LaneStats()
+	if stats[PriorityNormal].Queued != 2 || stats[PriorityNormal].Dropped != 1 {
+		t.Errorf("unexpected normal lane stats %+v", stats[PriorityNormal])
+	}
+	if stats[PriorityBulk].Queued != 2 || stats[PriorityBulk].Dropped != 2 {
+		t.Errorf("unexpected bulk lane stats %+v", stats[PriorityBulk])
+	}
+}
+
+func TestLanePriorityOrder(t *testing.T) {
+	var s = newSender(NewServer("a", ""), nil)
+	s.BroadcastPriority(PriorityBulk, []byte("bulk"))
+	s.BroadcastPriority(PriorityControl, []byte("control"))
+
+	var msgs = s.getBroadcasts(0, 1400)
+	if len(msgs) != 2 || string(msgs[0]) != "control" || string(msgs[1]) != "bulk" {
+		t.Errorf("control lane should be sent first, got %q", msgs)
+	}
+
+	// limit only fits the first one
+	s.BroadcastPriority(PriorityBulk, []byte("bulk"))
+	s.BroadcastPriority(PriorityControl, []byte("control"))
+	msgs = s.getBroadcasts(0, 10)
+	if len(msgs) != 1 || string(msgs[0]) != "control" {
+		t.Errorf("unexpected broadcasts %q", msgs)
+	}
+}
+
+func TestLaneDropReported(t *testing.T) {
+	var srv = NewServer("a", "")
+	srv.Lanes[PriorityNormal] = LaneConfig{MaxDepth: 1, Policy: DropOldest}
+	var s = newSender(srv, nil)
+
+	var results = make(map[string]BroadcastResult)
+	for _, key := range []string{"x", "y"} {
+		var key = key
+		s.BroadcastKeyed(key, []byte(key), func(result BroadcastResult) {
+			results[key] = result
+		})
+	}
+	if r, ok := results["x"]; !ok || r != BroadcastDropped {
+		t.Errorf("evicted broadcast should be reported as dropped, got %v", results)
+	}
+	if _, ok := results["y"]; ok {
+		t.Errorf("queued broadcast should not be finished, got %v", results)
+	}
+}
+
+func TestLaneConcurrentDrop(t *testing.T) {
+	var srv = NewServer("a", "")
+	srv.Lanes[PriorityNormal] = LaneConfig{MaxDepth: 10, Policy: DropOldest}
+	var s = newSender(srv, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.Broadcast([]byte("x"))
+			}
+		}()
+	}
+	wg.Wait()
+	var st = s.LaneStats()[PriorityNormal]
+	if st.Queued != 10 || st.Dropped != 790 {
+		t.Errorf("unexpected lane stats %+v", st)
+	}
+}
@@ -0,0 +1,313 @@
+package gossip
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+
+	"github.com/cjey/gbase/context"
+)
+
+// ErrServing means the server is starting or running already
+var ErrServing = errors.New("already serving")
+
+// ErrNotRunning means the server is not running
+var ErrNotRunning = errors.New("not running")
+
+// State is the lifecycle state of server
+//
+//	Idle -> Starting -> Running -> Stopping -> Stopped -> Starting ...
+//
+// A failed start goes to Stopped directly, the server could be started again from Stopped
+type State int
+
+const (
+	// StateIdle means the server is never started
+	StateIdle State = iota
+	StateStarting
+	StateRunning
+	StateStopping
+	StateStopped
+)
+
+func (st State) String() string {
+	switch st {
+	case StateIdle:
+		return "idle"
+	case StateStarting:
+		return "starting"
+	case StateRunning:
+		return "running"
+	case StateStopping:
+		return "stopping"
+	case StateStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// _LEAVE_TIMEOUT 停止时等待leave消息广播出去的默认时间
+const _LEAVE_TIMEOUT = 5 * time.Second
+
+// State return the current lifecycle state
+func (s *Server) State() State {
+	s.lmu.RLock()
+	defer s.lmu.RUnlock()
+	return s.state
+}
+
+// Ready return a channel closed once the memberlist of the current run is created,
+// after stopped, it returns the channel of the next run
+func (s *Server) Ready() <-chan struct{} {
+	var ready, _ = s.signals()
+	return ready
+}
+
+// signals 返回当前运行周期的ready和shutsig
+func (s *Server) signals() (ready, shutsig chan struct{}) {
+	s.lmu.RLock()
+	defer s.lmu.RUnlock()
+	return s.ready, s.shutsig
+}
+
+func (s *Server) setState(st State) {
+	s.lmu.Lock()
+	s.state = st
+	s.lmu.Unlock()
+}
+
+// finish 结束当前运行周期，并为下一次启动准备新的信号，调用方必须持有s.mu
+func (s *Server) finish() {
+	s.lmu.Lock()
+	close(s.shutsig)
+	s.state = StateStopped
+	s.ready = make(chan struct{})
+	s.shutsig = make(chan struct{})
+	s.lmu.Unlock()
+
+	// memberlist已经关闭，不会再有离开通知，下次启动时需要重新加入所有seeds
+	s.bmu.Lock()
+	for addr := range s.bootstraps {
+		s.bootstraps[addr] = false
+	}
+	s.bmu.Unlock()
+	s.pmu.Lock()
+	s.peers = make(map[string]*Node)
+	s.pmu.Unlock()
+	s.membersChanged()
+}
+
+// Start create the memberlist by Config, and attempt to join the Bootstraps, discovered seeds and snapshot once,
+// it returns after the attempt, failing to join any seed is not an error.
+// Discovery is bounded by Config.TCPTimeout, the seeds discovered later are joined in background.
+// ctx is used for logging, the server is stopped once ctx is done.
+func (s *Server) Start(ctx context.Context) error {
+	var _, err = s.start(ctx)
+	return err
+}
+
+// start 返回本次运行的shutsig，Serve用它等待停止
+func (s *Server) start(ctx context.Context) (chan struct{}, error) {
+	s.mu.Lock()
+	var locked = true
+	var unlock = func() {
+		if locked {
+			locked = false
+			s.mu.Unlock()
+		}
+	}
+	defer unlock()
+
+	if st := s.State(); st == StateStarting || st == StateRunning {
+		return nil, ErrServing
+	}
+	s.setState(StateStarting)
+	var ready, shutsig = s.signals()
+	if s.RemoteKeyring {
+		s.keyring.acceptRemote()
+	}
+
+	var cfg = s.Config
+	if cfg.LogOutput == nil && s.Overrides&OverrideLogger != 0 && (cfg.Logger == nil || cfg.Logger == s.logger) {
+		var l = newLogWriter(ctx, _LOG_LEVEL_WARN)
+		l.srv = s
+		s.logger = log.New(l, "", 0)
+		cfg.Logger = s.logger
+	} else if s.ObserveLog {
+		ctx.Warn("ObserveLog takes no effect with custom logger")
+	}
+
+	// set delegate
+	var dgm = newDelegateM(s)
+	s.ctx = ctx
+	s.setName(cfg.Name) // self join will be notified while creating
+	s.keepTransport()
+	s.lmu.Lock()
+	s.sender = dgm.sender
+	s.lmu.Unlock()
+	cfg.Delegate = dgm
+	cfg.Events = dgm
+	cfg.Ping = dgm
+	cfg.Alive = dgm
+	cfg.Merge = dgm
+	cfg.Conflict = dgm
+	atomic.StoreInt32(&s.renamed, 0)
+	atomic.StoreInt64(&s.started, time.Now().UnixNano())
+
+	// create server use retry policy
+	var ecnt = 0
+	for {
+		var srv, err = s.createMemberlist()
+		if err == nil {
+			s.setMemberlist(srv)
+			break
+		}
+		ecnt++
+		if ecnt >= 10 { // total retry 10 times, total wait 45s
+			s.finish()
+			return nil, fmt.Errorf("gossip server serve failed after creating memberlist 10 times, %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			s.finish()
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(ecnt) * time.Second):
+		}
+	}
+	s.setState(StateRunning)
+	close(ready)
+	var ml, self = s.memberlist, s.selfAddr()
+	unlock()
+
+	dgm.start()
+
+	if seeds := s.updateSeeds(s.discoverSeeds(self)); len(seeds) > 0 {
+		if _, err := ml.Join(seeds); err != nil {
+			s.ctx.Warn("Join seeds failed", "seeds", seeds, "err", err)
+		}
+	}
+	if len(s.Bootstraps) > 0 || s.Discoverer != nil || s.SnapshotPath != "" {
+		go s.keepSeedsOnline(self, shutsig)
+	}
+	if s.SnapshotPath != "" {
+		go s.keepSnapshot(shutsig)
+	}
+	go s.reportMetrics(shutsig)
+	go s.watchProbes(shutsig)
+	go s.queries.keepPruning(shutsig)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if _, cur := s.signals(); cur == shutsig && s.State() == StateRunning {
+				s.stop(_LEAVE_TIMEOUT)
+			}
+		case <-shutsig:
+		}
+	}()
+	return shutsig, nil
+}
+
+// createMemberlist 每次都使用配置的副本和当前的名字创建，已经关闭的memberlist可能仍有协程在读取它的配置，调用方必须持有s.mu
+func (s *Server) createMemberlist() (*memberlist.Memberlist, error) {
+	var cfg = *s.Config
+	// 重命名后的名字只保存在运行时，不修改用户的配置
+	cfg.Name = s.localName()
+	// 以运行时的keyring为准，同时给出SecretKey时memberlist会再次把它设为主密钥
+	if kr, err := s.keyring.keyring(); err == nil {
+		cfg.Keyring, cfg.SecretKey = kr, nil
+	} else if err != ErrEncryptionDisabled {
+		return nil, err
+	}
+	return memberlist.Create(&cfg)
+}
+
+// selfAddr 本节点的地址，用于从seeds中排除自己，绑定地址不确定时使用通告地址
+func (s *Server) selfAddr() string {
+	var ip = net.ParseIP(s.Config.BindAddr)
+	if ip == nil || ip.IsUnspecified() || s.Config.BindPort == 0 {
+		return s.memberlist.LocalNode().Address()
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(s.Config.BindPort))
+}
+
+// Stop broadcast leave and shutdown the memberlist, the server could be started again later.
+// It waits the leave broadcast until the deadline of ctx, or 5 seconds if no deadline.
+func (s *Server) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch s.State() {
+	case StateRunning:
+	case StateIdle:
+		// 尚未启动，后续阻塞在waitReady上的调用直接返回
+		s.finish()
+		return nil
+	default:
+		return nil
+	}
+
+	var timeout = _LEAVE_TIMEOUT
+	if d, ok := ctx.Deadline(); ok {
+		timeout = time.Until(d)
+	}
+	return s.stop(timeout)
+}
+
+// stop 调用方必须持有s.mu，并且处于运行状态
+func (s *Server) stop(timeout time.Duration) error {
+	s.setState(StateStopping)
+	defer s.finish()
+
+	if s.SnapshotPath != "" {
+		if err := s.saveSnapshot(); err != nil {
+			s.ctx.Warn("Save peers snapshot failed", "path", s.SnapshotPath, "err", err)
+		}
+	}
+
+	// first, announce the leave, so others won't take it as dead
+	var start = time.Now()
+	s.announceLeave(timeout / 2)
+	// then broadcast Leave message
+	var err = s.memberlist.Leave(timeout - time.Since(start))
+	// then shutdown, even if leave failed
+	if e := s.memberlist.Shutdown(); e != nil {
+		return e
+	}
+	return err
+}
+
+// Rejoin join the cluster again.
+// If running, e.g. isolated by network failure, it joins all the Bootstraps and discovered seeds immediately,
+// return the number of nodes joined. If stopped or never started, it starts the server by Start.
+func (s *Server) Rejoin(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	switch s.State() {
+	case StateIdle, StateStopped:
+		s.mu.Unlock()
+		if err := s.Start(ctx); err != nil {
+			return 0, err
+		}
+		return len(s.Others()), nil
+	case StateRunning:
+	default:
+		s.mu.Unlock()
+		return 0, fmt.Errorf("%w, server is %s", ErrNotRunning, s.State())
+	}
+	var ml, self = s.memberlist, s.selfAddr()
+	s.mu.Unlock()
+
+	var seeds = s.discoverSeeds(self)
+	s.updateSeeds(seeds)
+	if len(seeds) == 0 {
+		return 0, nil
+	}
+	return ml.Join(seeds)
+}
@@ -16,6 +16,8 @@ const (
 type logWriter struct {
 	ctx context.Context
 	lvl int
+	// 开启ObserveLog时从memberlist的日志中统计加密错误
+	srv *Server
 }
 
 func newLogWriter(ctx context.Context, lvl int) *logWriter {
@@ -51,31 +53,26 @@ func (l *logWriter) trimLevel(p []byte) ([]byte, int) {
 }
 
 func (l *logWriter) Write(p []byte) (int, error) {
-	if bytes.Contains(p, []byte("ping")) {
-		// ignore all ping log
-		return len(p), nil
-	}
-
 	var ol = len(p)
 	var lvl int
 	p = bytes.TrimSpace(p)
 	p, lvl = l.trimLevel(p)
+	p = bytes.TrimPrefix(p, []byte("memberlist: "))
+	if isPingLog(p) {
+		// ignore all ping log
+		return ol, nil
+	}
+	var encryption = lvl == _LOG_LEVEL_ERROR && isEncryptionLog(p)
+	if encryption && l.srv != nil && l.srv.ObserveLog {
+		l.srv.count(&l.srv.stats.encryptErrors, "gossip.encryption.errors", 1)
+	}
 	if lvl < l.lvl {
 		return ol, nil
 	}
-	p = bytes.TrimPrefix(p, []byte("memberlist: "))
 	switch lvl {
 	case _LOG_LEVEL_ERROR:
-		var lower bool
 		// let encryption message lower level
-		for _, kw := range [][]byte{[]byte("Encrypt"), []byte("encrypt"), []byte("Descrypt"), []byte("decrypt")} {
-			if bytes.Contains(p, kw) {
-				lower = true
-				break
-				l.ctx.Warn(string(p))
-			}
-		}
-		if lower {
+		if encryption {
 			l.ctx.Warn(string(p))
 		} else {
 			l.ctx.Error(string(p))
@@ -89,3 +86,35 @@ func (l *logWriter) Write(p []byte) (int, error) {
 	}
 	return ol, nil
 }
+
+// memberlist的ping日志，只按照消息开头匹配，节点名中带有ping的其他日志不受影响
+var pingLogs = [][]byte{
+	[]byte("Failed to decode ping"),
+	[]byte("Failed to decode indirect ping"),
+	[]byte("Failed to encode ping"),
+	[]byte("Failed to send ping"),
+	[]byte("Failed to send indirect ping"),
+	[]byte("Failed to send compound ping"),
+	[]byte("Failed ping:"),
+	[]byte("Failed fallback ping:"),
+	[]byte("Failed UDP ping:"),
+	[]byte("Got ping for unexpected node"),
+}
+
+func isPingLog(p []byte) bool {
+	for _, prefix := range pingLogs {
+		if bytes.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isEncryptionLog(p []byte) bool {
+	for _, kw := range [][]byte{[]byte("Encrypt"), []byte("encrypt"), []byte("Descrypt"), []byte("Decrypt"), []byte("decrypt")} {
+		if bytes.Contains(p, kw) {
+			return true
+		}
+	}
+	return false
+}
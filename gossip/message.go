@@ -0,0 +1,91 @@
+package gossip
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// messageKind 用于区分复用同一通道的不同子系统，紧跟在messageMagic之后
+type messageKind uint8
+
+const (
+	kindUser    messageKind = iota // 原始用户数据，投递给Delegate.NotifyMessage
+	kindKV                         // KV的增量数据
+	kindTopic                      // 带topic信封的发布订阅消息
+	kindRPC                        // RPC的请求和响应
+	kindKeyed                      // 带key和版本号的广播，新的会取代旧的
+	kindEvent                      // 带lamport时间的用户事件
+	kindQuery                      // 分布式查询及其应答
+	kindFailure                    // 失败检测的怀疑和反驳通知
+	kindStream                     // 大数据的分块传输
+)
+
+// messageMagic 内置子系统的消息格式：magic(3) | kind(1) | body
+// 旧版本的节点只收发原始用户数据，和元数据一样用多字节的前缀区分，没有这个前缀的消息整体视为原始用户数据，
+// 原始用户数据仍然不带前缀发出，只有恰好以magic开头时才加上kindUser前缀转义，所以新旧节点可以混合部署(滚动升级)，
+// 旧节点会把内置子系统(KV、topic、事件等)的消息当作原始用户数据，所有节点升级之前不应使用这些功能
+const messageMagic = "\xc7gm"
+
+func encodeMessage(kind messageKind, msg []byte) []byte {
+	if kind == kindUser && !hasMessageMagic(msg) {
+		return append([]byte(nil), msg...)
+	}
+	var buf = make([]byte, len(messageMagic)+1+len(msg))
+	copy(buf, messageMagic)
+	buf[len(messageMagic)] = byte(kind)
+	copy(buf[len(messageMagic)+1:], msg)
+	return buf
+}
+
+func decodeMessage(buf []byte) (messageKind, []byte) {
+	if !hasMessageMagic(buf) || len(buf) == len(messageMagic) {
+		return kindUser, buf
+	}
+	return messageKind(buf[len(messageMagic)]), buf[len(messageMagic)+1:]
+}
+
+func hasMessageMagic(buf []byte) bool {
+	return len(buf) >= len(messageMagic) && string(buf[:len(messageMagic)]) == messageMagic
+}
+
+var errMalformedMessage = errors.New("malformed message")
+
+// push/pull交换的完整状态，用户事件的lamport时间也随之交换，重启的节点加入时即可追上集群的时钟：
+// uvarint(event ltime) | KV的完整状态
+func encodeState(ltime uint64, kv []byte) []byte {
+	var buf = make([]byte, 0, binary.MaxVarintLen64+len(kv))
+	buf = appendUvarint(buf, ltime)
+	return append(buf, kv...)
+}
+
+func decodeState(buf []byte) (uint64, []byte, error) {
+	return readUvarint(buf)
+}
+
+// appendString 以uvarint长度前缀的方式追加字符串
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+// readString 读取由appendString写入的字符串，返回剩余的数据
+func readString(buf []byte) (string, []byte, error) {
+	var n, rest, err = readUvarint(buf)
+	if err != nil || uint64(len(rest)) < n {
+		return "", nil, errMalformedMessage
+	}
+	return string(rest[:n]), rest[n:], nil
+}
+
+func readUvarint(buf []byte) (uint64, []byte, error) {
+	var v, l = binary.Uvarint(buf)
+	if l <= 0 {
+		return 0, nil, errMalformedMessage
+	}
+	return v, buf[l:], nil
+}
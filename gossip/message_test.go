@@ -0,0 +1,32 @@
+package gossip
+
+import (
+	"testing"
+)
+
+func TestMessageKind(t *testing.T) {
+	for _, c := range []struct {
+		kind messageKind
+		msg  string
+	}{
+		{kindUser, "raw"},
+		{kindUser, ""},
+		{kindUser, messageMagic + "\x01looks like kv"},
+		{kindKV, "kv"},
+		{kindStream, ""},
+	} {
+		var buf = encodeMessage(c.kind, []byte(c.msg))
+		var kind, body = decodeMessage(buf)
+		if kind != c.kind || string(body) != c.msg {
+			t.Errorf("%d %q decoded as %d %q", c.kind, c.msg, kind, body)
+		}
+	}
+
+	// raw user messages are sent as is, so that the nodes before the kind prefix understand them
+	if buf := encodeMessage(kindUser, []byte("raw")); string(buf) != "raw" {
+		t.Errorf("raw message should not be prefixed, got %q", buf)
+	}
+	if kind, body := decodeMessage([]byte("legacy")); kind != kindUser || string(body) != "legacy" {
+		t.Errorf("legacy message decoded as %d %q", kind, body)
+	}
+}
@@ -0,0 +1,331 @@
+package gossip
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gometrics "github.com/armon/go-metrics"
+)
+
+// MetricsSink receive the metrics of gossip server, it must be safe for concurrent use.
+// Metric names are dot separated, e.g. gossip.msg.received
+type MetricsSink interface {
+	// IncrCounter add delta to a monotonic counter
+	IncrCounter(name string, delta float64)
+	// SetGauge set the current value of a gauge
+	SetGauge(name string, value float64)
+	// AddSample add a sample of a distribution, e.g. latency in milliseconds
+	AddSample(name string, value float64)
+}
+
+// Stats is the snapshot of the gossip server
+type Stats struct {
+	Name    string
+	Members int
+	// Health is the awareness score of local node, 0 means healthy, larger is worse
+	Health int
+
+	// MessagesSent and BytesSent count the direct messages and broadcasts handed to memberlist
+	MessagesSent     uint64
+	MessagesReceived uint64
+	BytesSent        uint64
+	BytesReceived    uint64
+
+	// BroadcastsQueued is the number of broadcasts queued since serving
+	BroadcastsQueued uint64
+	// BroadcastsSent is the number of broadcasts piggybacked on gossip packets, include retransmissions
+	BroadcastsSent uint64
+	Lanes          []LaneStats
+
+	Probes uint64
+	// Suspects, Refutes and Deaths count the MemberSuspect, MemberRefute and MemberDead events
+	Suspects  uint64
+	Refutes   uint64
+	Deaths    uint64
+	Rejected  uint64
+	Conflicts uint64
+	// EncryptionErrors is parsed from the logs of memberlist, only available with Server.ObserveLog
+	EncryptionErrors uint64
+}
+
+// _METRICS_INTERVAL 定期向MetricsSink上报gauge的周期
+const _METRICS_INTERVAL = 10 * time.Second
+
+type serverStats struct {
+	msgSent       uint64
+	msgReceived   uint64
+	bytesSent     uint64
+	bytesReceived uint64
+	bcQueued      uint64
+	bcSent        uint64
+	probes        uint64
+	suspects      uint64
+	refutes       uint64
+	deaths        uint64
+	conflicts     uint64
+	encryptErrors uint64
+}
+
+// count 累加计数，并转发给MetricsSink
+func (s *Server) count(counter *uint64, name string, delta uint64) {
+	atomic.AddUint64(counter, delta)
+	if s.Metrics != nil {
+		s.Metrics.IncrCounter(name, float64(delta))
+	}
+}
+
+func (s *Server) sample(name string, value float64) {
+	if s.Metrics != nil {
+		s.Metrics.AddSample(name, value)
+	}
+}
+
+func (s *Server) countSent(msg []byte) {
+	s.count(&s.stats.msgSent, "gossip.msg.sent", 1)
+	s.count(&s.stats.bytesSent, "gossip.bytes.sent", uint64(len(msg)))
+}
+
+func (s *Server) countReceived(msg []byte) {
+	s.count(&s.stats.msgReceived, "gossip.msg.received", 1)
+	s.count(&s.stats.bytesReceived, "gossip.bytes.received", uint64(len(msg)))
+}
+
+// Stats return the snapshot of server
+func (s *Server) Stats() Stats {
+	var st = Stats{
+		Name:    s.localName(),
+		Members: len(s.Peers()),
+
+		MessagesSent:     atomic.LoadUint64(&s.stats.msgSent),
+		MessagesReceived: atomic.LoadUint64(&s.stats.msgReceived),
+		BytesSent:        atomic.LoadUint64(&s.stats.bytesSent),
+		BytesReceived:    atomic.LoadUint64(&s.stats.bytesReceived),
+
+		BroadcastsQueued: atomic.LoadUint64(&s.stats.bcQueued),
+		BroadcastsSent:   atomic.LoadUint64(&s.stats.bcSent),
+		Lanes:            s.currentSender().LaneStats(),
+
+		Probes:           atomic.LoadUint64(&s.stats.probes),
+		Suspects:         atomic.LoadUint64(&s.stats.suspects),
+		Refutes:          atomic.LoadUint64(&s.stats.refutes),
+		Deaths:           atomic.LoadUint64(&s.stats.deaths),
+		Rejected:         s.Rejected(),
+		Conflicts:        atomic.LoadUint64(&s.stats.conflicts),
+		EncryptionErrors: atomic.LoadUint64(&s.stats.encryptErrors),
+	}
+	if ml := s.currentMemberlist(); ml != nil {
+		st.Health = ml.GetHealthScore()
+	}
+	return st
+}
+
+// reportMetrics 定期上报gauge，直到本次运行结束
+func (s *Server) reportMetrics(shutsig chan struct{}) {
+	if s.Metrics == nil {
+		return
+	}
+	var ticker = time.NewTicker(_METRICS_INTERVAL)
+	defer ticker.Stop()
+	for {
+		var st = s.Stats()
+		s.Metrics.SetGauge("gossip.members", float64(st.Members))
+		s.Metrics.SetGauge("gossip.health", float64(st.Health))
+		for _, l := range st.Lanes {
+			s.Metrics.SetGauge("gossip.lane."+l.Priority.String()+".queued", float64(l.Queued))
+			s.Metrics.SetGauge("gossip.lane."+l.Priority.String()+".dropped", float64(l.Dropped))
+		}
+		select {
+		case <-shutsig:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// MetricsRegistry is an in-memory MetricsSink,
+// it could be exported by expvar or prometheus text format
+type MetricsRegistry struct {
+	mu       sync.RWMutex
+	counters map[string]float64
+	gauges   map[string]float64
+	samples  map[string]*sampleSummary
+}
+
+type sampleSummary struct {
+	Count uint64
+	Sum   float64
+	Min   float64
+	Max   float64
+}
+
+var _ MetricsSink = &MetricsRegistry{}
+var _ http.Handler = &MetricsRegistry{}
+
+// NewMetricsRegistry return an empty registry
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+		samples:  make(map[string]*sampleSummary),
+	}
+}
+
+func (r *MetricsRegistry) IncrCounter(name string, delta float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[name] += delta
+}
+
+func (r *MetricsRegistry) SetGauge(name string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gauges[name] = value
+}
+
+func (r *MetricsRegistry) AddSample(name string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var s = r.samples[name]
+	if s == nil {
+		s = &sampleSummary{Min: value, Max: value}
+		r.samples[name] = s
+	}
+	s.Count++
+	s.Sum += value
+	if value < s.Min {
+		s.Min = value
+	}
+	if value > s.Max {
+		s.Max = value
+	}
+}
+
+// Snapshot return a copy of all metrics, used by expvar
+func (r *MetricsRegistry) Snapshot() map[string]interface{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var snap = make(map[string]interface{}, len(r.counters)+len(r.gauges)+len(r.samples))
+	for k, v := range r.counters {
+		snap[k] = v
+	}
+	for k, v := range r.gauges {
+		snap[k] = v
+	}
+	for k, v := range r.samples {
+		snap[k] = *v
+	}
+	return snap
+}
+
+// Publish export the registry by expvar with the given name, it panics if the name is used
+func (r *MetricsRegistry) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return r.Snapshot()
+	}))
+}
+
+// promName 转换为prometheus的指标名字
+func promName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// WriteTo write all metrics in prometheus text format
+func (r *MetricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	var write = func(kind string, values map[string]float64, suffix string) {
+		var names = make([]string, 0, len(values))
+		for k := range values {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			var name = promName(k) + suffix
+			fmt.Fprintf(&buf, "# TYPE %s %s\n%s %v\n", name, kind, name, values[k])
+		}
+	}
+
+	r.mu.RLock()
+	write("counter", r.counters, "_total")
+	write("gauge", r.gauges, "")
+	var names = make([]string, 0, len(r.samples))
+	for k := range r.samples {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		var name, s = promName(k), r.samples[k]
+		fmt.Fprintf(&buf, "# TYPE %s summary\n%s_sum %v\n%s_count %d\n", name, name, s.Sum, name, s.Count)
+	}
+	r.mu.RUnlock()
+
+	var n, err = w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// ServeHTTP serve the metrics in prometheus text format
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+// memberlistSink 把memberlist内部通过go-metrics上报的指标转发给MetricsSink
+type memberlistSink struct {
+	sink MetricsSink
+}
+
+func (m *memberlistSink) name(key []string) string {
+	return strings.Join(key, ".")
+}
+
+func (m *memberlistSink) SetGauge(key []string, val float32) {
+	m.sink.SetGauge(m.name(key), float64(val))
+}
+
+func (m *memberlistSink) SetGaugeWithLabels(key []string, val float32, labels []gometrics.Label) {
+	m.SetGauge(key, val)
+}
+
+func (m *memberlistSink) EmitKey(key []string, val float32) {
+}
+
+func (m *memberlistSink) IncrCounter(key []string, val float32) {
+	m.sink.IncrCounter(m.name(key), float64(val))
+}
+
+func (m *memberlistSink) IncrCounterWithLabels(key []string, val float32, labels []gometrics.Label) {
+	m.IncrCounter(key, val)
+}
+
+func (m *memberlistSink) AddSample(key []string, val float32) {
+	m.sink.AddSample(m.name(key), float64(val))
+}
+
+func (m *memberlistSink) AddSampleWithLabels(key []string, val float32, labels []gometrics.Label) {
+	m.AddSample(key, val)
+}
+
+// InstallMemberlistMetrics forward the internal counters of memberlist to the sink,
+// e.g. memberlist.udp.sent, memberlist.msg.suspect.
+// memberlist reports to the process-wide go-metrics, so it affects all servers in the process.
+func InstallMemberlistMetrics(sink MetricsSink) error {
+	var cfg = gometrics.DefaultConfig("")
+	cfg.EnableHostname = false
+	cfg.EnableHostnameLabel = false
+	cfg.EnableRuntimeMetrics = false
+	cfg.EnableServiceLabel = false
+	var _, err = gometrics.NewGlobal(cfg, &memberlistSink{sink: sink})
+	return err
+}
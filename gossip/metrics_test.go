@@ -0,0 +1,68 @@
+package gossip
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+
+	"github.com/cjey/gbase/context"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	var r = NewMetricsRegistry()
+	r.IncrCounter("gossip.msg.sent", 1)
+	r.IncrCounter("gossip.msg.sent", 2)
+	r.SetGauge("gossip.members", 3)
+	r.AddSample("gossip.probe.rtt", 1.5)
+	r.AddSample("gossip.probe.rtt", 2.5)
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"gossip_msg_sent_total 3",
+		"gossip_members 3",
+		"gossip_probe_rtt_sum 4",
+		"gossip_probe_rtt_count 2",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing %q in\n%s", line, buf.String())
+		}
+	}
+	if v := r.Snapshot()["gossip.probe.rtt"].(sampleSummary); v.Min != 1.5 || v.Max != 2.5 {
+		t.Errorf("unexpected summary %+v", v)
+	}
+}
+
+func TestMetricsStats(t *testing.T) {
+	var s = NewServer("a", "")
+	s.name = "a"
+	var r = NewMetricsRegistry()
+	s.Metrics = r
+	s.ObserveLog = true
+	s.sender = newSender(s, nil)
+	s.peers["b"] = newNode(&memberlist.Node{Name: "b"})
+
+	s.countReceived([]byte("hello"))
+	s.sender.Broadcast([]byte("x"))
+
+	var l = newLogWriter(context.Simple(), _LOG_LEVEL_ERROR+1)
+	l.srv = s
+	l.Write([]byte("[ERR] memberlist: Decrypt packet failed: No installed keys could decrypt the message"))
+	s.nodeSuspect(s.Peer("b"), "a", true)
+
+	// the suspicion is broadcast too
+	var st = s.Stats()
+	if st.MessagesReceived != 1 || st.BytesReceived != 5 || st.BroadcastsQueued != 2 {
+		t.Errorf("unexpected message stats %+v", st)
+	}
+	if st.EncryptionErrors != 1 || st.Suspects != 1 {
+		t.Errorf("unexpected failure stats %+v", st)
+	}
+	if r.Snapshot()["gossip.encryption.errors"] != 1.0 {
+		t.Errorf("encryption errors should be reported to sink")
+	}
+}
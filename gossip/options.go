@@ -0,0 +1,251 @@
+package gossip
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// ErrInvalidOptions means the options or the resulting config is invalid
+var ErrInvalidOptions = errors.New("invalid options")
+
+// Profile is the preset timing of failure detection and gossip
+type Profile int
+
+const (
+	// ProfileLAN is tuned for nodes in the same data center, it's the default of NewServer
+	ProfileLAN Profile = iota
+	// ProfileWAN is tuned for nodes across regions, with higher latency and slower convergence
+	ProfileWAN
+	// ProfileLocal is tuned for nodes in the same host or test environment
+	ProfileLocal
+)
+
+func (p Profile) String() string {
+	switch p {
+	case ProfileLAN:
+		return "lan"
+	case ProfileWAN:
+		return "wan"
+	case ProfileLocal:
+		return "local"
+	}
+	return "unknown"
+}
+
+// apply 在NewServer的LAN配置基础上调整时间参数，参考memberlist的默认配置
+func (p Profile) apply(cfg *memberlist.Config) error {
+	switch p {
+	case ProfileLAN:
+	case ProfileWAN:
+		cfg.TCPTimeout = 30 * time.Second
+		cfg.SuspicionMult = 6
+		cfg.PushPullInterval = 60 * time.Second
+		cfg.ProbeTimeout = 3 * time.Second
+		cfg.ProbeInterval = 5 * time.Second
+		cfg.GossipNodes = 4
+		cfg.GossipInterval = 500 * time.Millisecond
+		cfg.GossipToTheDeadTime = 60 * time.Second
+	case ProfileLocal:
+		cfg.TCPTimeout = time.Second
+		cfg.IndirectChecks = 1
+		cfg.RetransmitMult = 2
+		cfg.SuspicionMult = 3
+		cfg.PushPullInterval = 15 * time.Second
+		cfg.ProbeTimeout = 200 * time.Millisecond
+		cfg.ProbeInterval = time.Second
+		cfg.GossipInterval = 100 * time.Millisecond
+		cfg.GossipToTheDeadTime = 15 * time.Second
+	default:
+		return fmt.Errorf("%w, unknown profile %d", ErrInvalidOptions, p)
+	}
+	return nil
+}
+
+// Override is the set of settings Serve is allowed to override.
+// It only covers the optional settings, the delegates of memberlist are always installed by Serve
+type Override int
+
+const (
+	// OverrideAdvertise allow Serve to set the advertise address as the bind address
+	OverrideAdvertise Override = 1 << iota
+	// OverrideLogger allow Serve to set a logger writing to the context if no logger configured
+	OverrideLogger
+
+	// OverrideAll is the default of NewServer
+	OverrideAll = OverrideAdvertise | OverrideLogger
+)
+
+// Options is the options of server
+type Options struct {
+	// Key is the passphrase of encryption, disabled if empty
+	Key     string
+	Profile Profile
+	// AdvertiseAddr is the address (host:port) announced to other nodes, used behind NAT,
+	// it's the bind address of Serve if empty
+	AdvertiseAddr string
+	// Overrides is the settings Serve is allowed to override, default OverrideAll,
+	// OverrideAdvertise is always removed if AdvertiseAddr is given
+	Overrides Override
+	// Logger receive the logs of memberlist, the logs are written to the context of Serve if nil
+	Logger *log.Logger
+	// ObserveLog count the encryption errors from the logs of memberlist, see Server.ObserveLog
+	ObserveLog bool
+	// RemoteKeyring allow other nodes to manage the keys of local node, see Server.RemoteKeyring
+	RemoteKeyring bool
+
+	Segment        Segment
+	ConflictPolicy ConflictPolicy
+	Discoverer     Discoverer
+	Metrics        MetricsSink
+	// SnapshotPath persist the known peers for rejoining after restart, disabled if empty
+	SnapshotPath string
+
+	// Tune adjust the memberlist config finally, after the profile applied
+	Tune func(*memberlist.Config)
+}
+
+// Option is the functional option of NewServerWithOptions
+type Option func(*Options)
+
+// WithKey enable encryption with the passphrase
+func WithKey(key string) Option {
+	return func(o *Options) { o.Key = key }
+}
+
+// WithProfile use the preset timing
+func WithProfile(p Profile) Option {
+	return func(o *Options) { o.Profile = p }
+}
+
+// WithAdvertise announce the address (host:port) instead of the bind address
+func WithAdvertise(addr string) Option {
+	return func(o *Options) { o.AdvertiseAddr = addr }
+}
+
+// WithOverrides set the settings Serve is allowed to override
+func WithOverrides(ov Override) Option {
+	return func(o *Options) { o.Overrides = ov }
+}
+
+// WithLogger write the logs of memberlist to the logger
+func WithLogger(l *log.Logger) Option {
+	return func(o *Options) { o.Logger = l }
+}
+
+// WithObserveLog count the encryption errors from the logs of memberlist
+func WithObserveLog() Option {
+	return func(o *Options) { o.ObserveLog = true }
+}
+
+// WithRemoteKeyring allow other nodes to manage the keys of local node
+func WithRemoteKeyring() Option {
+	return func(o *Options) { o.RemoteKeyring = true }
+}
+
+// WithSegment set the cluster identity
+func WithSegment(sg Segment) Option {
+	return func(o *Options) { o.Segment = sg }
+}
+
+// WithConflictPolicy set the policy of name conflict
+func WithConflictPolicy(p ConflictPolicy) Option {
+	return func(o *Options) { o.ConflictPolicy = p }
+}
+
+// WithDiscoverer discover seeds periodically
+func WithDiscoverer(d Discoverer) Option {
+	return func(o *Options) { o.Discoverer = d }
+}
+
+// WithSnapshot persist the known peers to the file, and use them as seeds on start
+func WithSnapshot(path string) Option {
+	return func(o *Options) { o.SnapshotPath = path }
+}
+
+// WithMetrics report metrics to the sink
+func WithMetrics(sink MetricsSink) Option {
+	return func(o *Options) { o.Metrics = sink }
+}
+
+// WithTune adjust the memberlist config finally
+func WithTune(fn func(*memberlist.Config)) Option {
+	return func(o *Options) { o.Tune = fn }
+}
+
+// NewServerWithOptions return a gossip server configured by options, the config is validated
+func NewServerWithOptions(name string, opts ...Option) (*Server, error) {
+	var o = Options{Overrides: OverrideAll}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%w, empty name", ErrInvalidOptions)
+	}
+
+	var s = NewServer(name, o.Key)
+	var cfg = s.Config
+	if err := o.Profile.apply(cfg); err != nil {
+		return nil, err
+	}
+	if o.AdvertiseAddr != "" {
+		var addr, err = net.ResolveTCPAddr("tcp", o.AdvertiseAddr)
+		if err != nil {
+			return nil, fmt.Errorf("%w, advertise address, %s", ErrInvalidOptions, err)
+		}
+		if addr.IP == nil || addr.IP.IsUnspecified() || addr.Port == 0 {
+			return nil, fmt.Errorf("%w, advertise address %s must be specific", ErrInvalidOptions, o.AdvertiseAddr)
+		}
+		cfg.AdvertiseAddr, cfg.AdvertisePort = addr.IP.String(), addr.Port
+		o.Overrides &^= OverrideAdvertise
+	}
+	cfg.Logger = o.Logger
+	if o.Tune != nil {
+		o.Tune(cfg)
+	}
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	s.Overrides = o.Overrides
+	s.ObserveLog = o.ObserveLog
+	s.RemoteKeyring = o.RemoteKeyring
+	s.Segment = o.Segment
+	s.ConflictPolicy = o.ConflictPolicy
+	s.Discoverer = o.Discoverer
+	s.Metrics = o.Metrics
+	s.SnapshotPath = o.SnapshotPath
+	return s, nil
+}
+
+// validateConfig 检查memberlist配置中互相关联的参数
+func validateConfig(cfg *memberlist.Config) error {
+	var invalid = func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w, %s", ErrInvalidOptions, fmt.Sprintf(format, args...))
+	}
+	switch {
+	case cfg.Name == "":
+		return invalid("empty name")
+	case cfg.ProbeInterval <= 0 || cfg.ProbeTimeout <= 0:
+		return invalid("probe interval and timeout must be positive")
+	case cfg.ProbeTimeout > cfg.ProbeInterval:
+		return invalid("probe timeout %s must not exceed probe interval %s", cfg.ProbeTimeout, cfg.ProbeInterval)
+	case cfg.GossipInterval <= 0 || cfg.GossipNodes <= 0:
+		return invalid("gossip interval and nodes must be positive")
+	case cfg.TCPTimeout <= 0:
+		return invalid("tcp timeout must be positive")
+	case cfg.PushPullInterval < 0:
+		return invalid("push/pull interval must not be negative")
+	case cfg.SuspicionMult <= 0 || cfg.RetransmitMult <= 0:
+		return invalid("suspicion and retransmit multiplier must be positive")
+	case cfg.UDPBufferSize <= 0:
+		return invalid("udp buffer size must be positive")
+	case cfg.Logger != nil && cfg.LogOutput != nil:
+		return invalid("logger and log output can not be both specified")
+	}
+	return nil
+}
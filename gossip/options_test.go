@@ -0,0 +1,66 @@
+package gossip
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func TestOptionsProfile(t *testing.T) {
+	var s, err = NewServerWithOptions("a", WithProfile(ProfileWAN), WithKey("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Config.ProbeInterval != 5*time.Second || len(s.Config.SecretKey) != 16 {
+		t.Errorf("wan profile is not applied")
+	}
+	if s.Overrides != OverrideAll {
+		t.Errorf("unexpected overrides %v", s.Overrides)
+	}
+	if _, err = NewServerWithOptions("a", WithProfile(Profile(9))); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unknown profile should be invalid, got %v", err)
+	}
+}
+
+func TestOptionsAdvertise(t *testing.T) {
+	var s, err = NewServerWithOptions("a", WithAdvertise("203.0.113.1:7946"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Config.AdvertiseAddr != "203.0.113.1" || s.Config.AdvertisePort != 7946 {
+		t.Errorf("unexpected advertise %s:%d", s.Config.AdvertiseAddr, s.Config.AdvertisePort)
+	}
+	if s.Overrides&OverrideAdvertise != 0 {
+		t.Error("serve should not override the advertise address")
+	}
+	for _, addr := range []string{"0.0.0.0:7946", "203.0.113.1:0", "bad"} {
+		if _, err = NewServerWithOptions("a", WithAdvertise(addr)); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("advertise %s should be invalid, got %v", addr, err)
+		}
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	var cases = map[string][]Option{
+		"empty name": nil,
+		"probe timeout": {WithTune(func(cfg *memberlist.Config) {
+			cfg.ProbeTimeout = 2 * cfg.ProbeInterval
+		})},
+		"both logger": {WithLogger(log.New(ioutil.Discard, "", 0)), WithTune(func(cfg *memberlist.Config) {
+			cfg.LogOutput = ioutil.Discard
+		})},
+	}
+	for name, opts := range cases {
+		var node = "a"
+		if name == "empty name" {
+			node = ""
+		}
+		if _, err := NewServerWithOptions(node, opts...); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("%s should be invalid, got %v", name, err)
+		}
+	}
+}
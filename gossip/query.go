@@ -0,0 +1,475 @@
+package gossip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cjey/gbase/context"
+)
+
+var (
+	// ErrQueryTooLarge means the encoded query exceeds QuerySizeLimit, try to narrow the targets
+	ErrQueryTooLarge = errors.New("query too large")
+	// ErrUnknownQuery means the responder did not register the query
+	ErrUnknownQuery = errors.New("unknown query")
+)
+
+// QuerySizeLimit is the max size of encoded query, include the payload and target names,
+// queries are piggybacked on gossip packets, so it must be small
+var QuerySizeLimit = 1024
+
+// QueryHandler answer the query from the given node, ctx has the deadline of origin
+type QueryHandler func(ctx context.Context, from string, payload []byte) (resp []byte, err error)
+
+// QueryResponse is the answer of a node
+type QueryResponse struct {
+	From    string
+	Payload []byte
+	// Err is ErrUnknownQuery if the node did not register the query, or *RemoteError if the handler failed
+	Err error
+}
+
+// QueryResult is the result collected by origin
+type QueryResult struct {
+	// Targets is all nodes asked, sorted
+	Targets []string
+	// Acks is the nodes which received the query, in arrival order
+	Acks []string
+	// Responses is in arrival order
+	Responses []*QueryResponse
+	// NoResponse is the targets which did not respond before deadline, sorted
+	NoResponse []string
+}
+
+const (
+	_QUERY_REQUEST  = 1
+	_QUERY_ACK      = 2
+	_QUERY_RESPONSE = 3
+
+	// 响应的错误码
+	_QUERY_ERR_HANDLER = 1
+	_QUERY_ERR_UNKNOWN = 2
+
+	// _QUERY_PRUNE_INTERVAL 定期清理过期的去重记录
+	_QUERY_PRUNE_INTERVAL = time.Second
+)
+
+type queryRequest struct {
+	// 随机生成，发起方重启后也不会与之前的查询重复
+	ID      uint64
+	From    string
+	Timeout time.Duration
+	// 为空表示所有节点
+	Targets []string
+	Name    string
+	Payload []byte
+}
+
+// 消息格式：
+// type(1) | uvarint(id) | uvarint(len(from)) | from | uvarint(timeout ms) | uvarint(n) | (uvarint(len(target)) | target)*n |
+// uvarint(len(name)) | name | payload
+func encodeQueryRequest(q *queryRequest) []byte {
+	var size = 1 + 4*binary.MaxVarintLen64 + len(q.From) + len(q.Name) + len(q.Payload)
+	for _, t := range q.Targets {
+		size += binary.MaxVarintLen64 + len(t)
+	}
+	var buf = make([]byte, 0, size)
+	buf = append(buf, _QUERY_REQUEST)
+	buf = appendUvarint(buf, q.ID)
+	buf = appendString(buf, q.From)
+	buf = appendUvarint(buf, uint64(q.Timeout/time.Millisecond))
+	buf = appendUvarint(buf, uint64(len(q.Targets)))
+	for _, t := range q.Targets {
+		buf = appendString(buf, t)
+	}
+	buf = appendString(buf, q.Name)
+	return append(buf, q.Payload...)
+}
+
+func decodeQueryRequest(buf []byte) (*queryRequest, error) {
+	var q = &queryRequest{}
+	var err error
+	var v, n uint64
+	if q.ID, buf, err = readUvarint(buf); err != nil {
+		return nil, err
+	}
+	if q.From, buf, err = readString(buf); err != nil {
+		return nil, err
+	}
+	if v, buf, err = readUvarint(buf); err != nil {
+		return nil, err
+	}
+	q.Timeout = time.Duration(v) * time.Millisecond
+	if n, buf, err = readUvarint(buf); err != nil {
+		return nil, err
+	}
+	if n > uint64(len(buf)) {
+		return nil, errMalformedMessage
+	}
+	for i := uint64(0); i < n; i++ {
+		var t string
+		if t, buf, err = readString(buf); err != nil {
+			return nil, err
+		}
+		q.Targets = append(q.Targets, t)
+	}
+	if q.Name, buf, err = readString(buf); err != nil {
+		return nil, err
+	}
+	q.Payload = buf
+	return q, nil
+}
+
+// 应答格式：
+// type(1) | uvarint(id) | uvarint(len(from)) | from，响应还有 | errcode(1) | uvarint(len(err)) | err | payload
+func encodeQueryReply(typ byte, id uint64, from string, code byte, errmsg string, payload []byte) []byte {
+	var buf = make([]byte, 0, 2+3*binary.MaxVarintLen64+len(from)+len(errmsg)+len(payload))
+	buf = append(buf, typ)
+	buf = appendUvarint(buf, id)
+	buf = appendString(buf, from)
+	if typ == _QUERY_RESPONSE {
+		buf = append(buf, code)
+		buf = appendString(buf, errmsg)
+		buf = append(buf, payload...)
+	}
+	return buf
+}
+
+// queryCollector 发起方收集应答，所有目标都响应后提前结束
+type queryCollector struct {
+	name string
+
+	mu        sync.Mutex
+	targets   map[string]bool
+	acked     map[string]bool
+	responded map[string]bool
+	result    *QueryResult
+	done      chan struct{}
+}
+
+func (c *queryCollector) ack(from string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.targets[from] && !c.acked[from] {
+		c.acked[from] = true
+		c.result.Acks = append(c.result.Acks, from)
+	}
+}
+
+func (c *queryCollector) respond(resp *QueryResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.targets[resp.From] || c.responded[resp.From] {
+		return
+	}
+	// 响应意味着已经收到，应答可能晚于响应到达
+	if !c.acked[resp.From] {
+		c.acked[resp.From] = true
+		c.result.Acks = append(c.result.Acks, resp.From)
+	}
+	c.responded[resp.From] = true
+	c.result.Responses = append(c.result.Responses, resp)
+	if len(c.responded) == len(c.targets) {
+		close(c.done)
+	}
+}
+
+// finish 返回结果的副本，之后到达的应答不影响它
+func (c *queryCollector) finish() *QueryResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var r = &QueryResult{
+		Targets:    c.result.Targets,
+		Acks:       append([]string(nil), c.result.Acks...),
+		Responses:  append([]*QueryResponse(nil), c.result.Responses...),
+		NoResponse: make([]string, 0),
+	}
+	for _, t := range r.Targets {
+		if !c.responded[t] {
+			r.NoResponse = append(r.NoResponse, t)
+		}
+	}
+	return r
+}
+
+type queries struct {
+	srv *Server
+
+	mu       sync.RWMutex
+	handlers map[string]QueryHandler
+	pending  map[uint64]*queryCollector
+
+	// key<from/id> => value<过期时间>，用于丢弃重复收到的查询
+	smu  sync.Mutex
+	seen map[string]time.Time
+}
+
+func newQueries(srv *Server) *queries {
+	return &queries{
+		srv:      srv,
+		handlers: make(map[string]QueryHandler),
+		pending:  make(map[uint64]*queryCollector),
+		seen:     make(map[string]time.Time),
+	}
+}
+
+// remember 记录查询直到它过期，已经见过则返回false
+func (q *queries) remember(req *queryRequest) bool {
+	var now = time.Now()
+	var key = fmt.Sprintf("%s/%d", req.From, req.ID)
+	q.smu.Lock()
+	defer q.smu.Unlock()
+	if expire, ok := q.seen[key]; ok && !now.After(expire) {
+		return false
+	}
+	q.seen[key] = now.Add(req.Timeout)
+	return true
+}
+
+// keepPruning 定期清理过期的去重记录，直到服务停止
+func (q *queries) keepPruning(shutsig chan struct{}) {
+	var ticker = time.NewTicker(_QUERY_PRUNE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutsig:
+			return
+		case now := <-ticker.C:
+			q.smu.Lock()
+			for k, expire := range q.seen {
+				if now.After(expire) {
+					delete(q.seen, k)
+				}
+			}
+			q.smu.Unlock()
+		}
+	}
+}
+
+func (q *queries) register(name string, h QueryHandler) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.handlers[name]; ok {
+		return fmt.Errorf("query %s already registered", name)
+	}
+	q.handlers[name] = h
+	return nil
+}
+
+func (q *queries) notifyMessage(msg []byte) {
+	if len(msg) == 0 {
+		return
+	}
+	// 查询会被异步处理和转发，必须复制
+	msg = append([]byte(nil), msg...)
+	switch msg[0] {
+	case _QUERY_REQUEST:
+		var req, err = decodeQueryRequest(msg[1:])
+		if err != nil || req.Timeout <= 0 || !q.remember(req) {
+			return
+		}
+		// 首次收到时再次广播，保证在较大的集群中也能送达所有目标
+		if sender := q.srv.currentSender(); sender != nil {
+			sender.queueBroadcast(PriorityNormal, broadcast(encodeMessage(kindQuery, msg)))
+		}
+		if req.targeted(q.srv.localName()) {
+			go q.serve(req)
+		}
+	case _QUERY_ACK, _QUERY_RESPONSE:
+		q.collect(msg)
+	}
+}
+
+func (req *queryRequest) targeted(name string) bool {
+	if len(req.Targets) == 0 {
+		return true
+	}
+	for _, t := range req.Targets {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// collect 发起方处理应答和响应，已经结束的查询直接忽略
+func (q *queries) collect(msg []byte) {
+	var typ = msg[0]
+	var id, buf, err = readUvarint(msg[1:])
+	if err != nil {
+		return
+	}
+	var from string
+	if from, buf, err = readString(buf); err != nil {
+		return
+	}
+	q.mu.RLock()
+	var c = q.pending[id]
+	q.mu.RUnlock()
+	if c == nil {
+		return
+	}
+	if typ == _QUERY_ACK {
+		c.ack(from)
+		return
+	}
+	if len(buf) == 0 {
+		return
+	}
+	var code, errmsg = buf[0], ""
+	if errmsg, buf, err = readString(buf[1:]); err != nil {
+		return
+	}
+	var resp = &QueryResponse{From: from, Payload: buf}
+	switch code {
+	case 0:
+	case _QUERY_ERR_UNKNOWN:
+		resp.Err = ErrUnknownQuery
+	default:
+		resp.Err = &RemoteError{Node: from, Method: c.name, Message: errmsg}
+	}
+	c.respond(resp)
+}
+
+// reply 发给发起方，发起方是本节点时直接收集
+func (q *queries) reply(req *queryRequest, msg []byte) {
+	if req.From == q.srv.localName() {
+		q.collect(msg)
+		return
+	}
+	var sender = q.srv.currentSender()
+	if sender == nil {
+		return
+	}
+	if err := sender.sendRaw(req.From, encodeMessage(kindQuery, msg), true); err != nil {
+		q.srv.ctx.Warn("Unavailable to reply query", "err", err, "node", req.From, "query", req.Name)
+	}
+}
+
+// call 执行handler，handler的panic作为错误返回给发起方
+func (q *queries) call(ctx context.Context, h QueryHandler, req *queryRequest) (resp []byte, err error) {
+	err = safeCall(ctx, "Query", func() (err error) {
+		resp, err = h(ctx, req.From, req.Payload)
+		return err
+	}, "query", req.Name, "from", req.From)
+	return resp, err
+}
+
+func (q *queries) serve(req *queryRequest) {
+	var name = q.srv.localName()
+	q.reply(req, encodeQueryReply(_QUERY_ACK, req.ID, name, 0, "", nil))
+
+	q.mu.RLock()
+	var h = q.handlers[req.Name]
+	q.mu.RUnlock()
+
+	var code byte
+	var errmsg string
+	var body []byte
+	if h == nil {
+		code = _QUERY_ERR_UNKNOWN
+	} else {
+		var ctx, cancel = q.srv.ctx.ForkAt("Query").WithTimeout(req.Timeout)
+		var resp, err = q.call(ctx, h, req)
+		var expired = ctx.Err() != nil
+		cancel()
+		if expired {
+			// 发起方已经不再等待
+			return
+		}
+		if err != nil {
+			code, errmsg = _QUERY_ERR_HANDLER, err.Error()
+		} else {
+			body = resp
+		}
+	}
+	q.reply(req, encodeQueryReply(_QUERY_RESPONSE, req.ID, name, code, errmsg, body))
+}
+
+func (q *queries) query(ctx context.Context, name string, payload []byte, filters []PeerFilter) (*QueryResult, error) {
+	var sender = q.srv.currentSender()
+	if sender == nil {
+		return nil, ErrNotRunning
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = ctx.WithTimeout(q.srv.Config.TCPTimeout)
+		defer cancel()
+	}
+	var deadline, _ = ctx.Deadline()
+
+	var c = &queryCollector{
+		name:      name,
+		targets:   make(map[string]bool),
+		acked:     make(map[string]bool),
+		responded: make(map[string]bool),
+		result:    &QueryResult{Targets: make([]string, 0)},
+		done:      make(chan struct{}),
+	}
+	for _, n := range q.srv.Select(filters...) {
+		c.targets[n.Name] = true
+		c.result.Targets = append(c.result.Targets, n.Name)
+	}
+	sort.Strings(c.result.Targets)
+	if len(c.targets) == 0 {
+		return c.finish(), nil
+	}
+
+	var req = &queryRequest{
+		ID:      rand.Uint64(),
+		From:    q.srv.localName(),
+		Timeout: time.Until(deadline),
+		Name:    name,
+		Payload: payload,
+	}
+	if len(filters) > 0 {
+		req.Targets = c.result.Targets
+	}
+	var msg = encodeQueryRequest(req)
+	if len(msg) > QuerySizeLimit {
+		return nil, fmt.Errorf("%w, %d bytes exceed %d", ErrQueryTooLarge, len(msg), QuerySizeLimit)
+	}
+
+	q.mu.Lock()
+	q.pending[req.ID] = c
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		delete(q.pending, req.ID)
+		q.mu.Unlock()
+	}()
+
+	q.remember(req)
+	sender.queueBroadcast(PriorityNormal, broadcast(encodeMessage(kindQuery, msg)))
+	if c.targets[req.From] {
+		go q.serve(req)
+	}
+
+	select {
+	case <-c.done:
+		return c.finish(), nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return c.finish(), nil
+		}
+		return c.finish(), ctx.Err()
+	}
+}
+
+// RegisterQuery register the handler answering the query with the name
+func (s *Server) RegisterQuery(name string, h QueryHandler) error {
+	return s.queries.register(name, h)
+}
+
+// Query broadcast the query to the nodes matching all filters (include local node), and collect their answers
+// by direct messages. It returns once all targets responded, or the deadline of ctx expired,
+// the targets without response are listed in NoResponse. If ctx has no deadline, Config.TCPTimeout will be used.
+// If ctx is canceled, the collected result is returned with the error of ctx.
+func (s *Server) Query(ctx context.Context, name string, payload []byte, filters ...PeerFilter) (*QueryResult, error) {
+	return s.queries.query(ctx, name, payload, filters)
+}
@@ -0,0 +1,117 @@
+package gossip
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+
+	"github.com/cjey/gbase/context"
+)
+
+func TestQueryEnvelope(t *testing.T) {
+	var req = &queryRequest{ID: 7, From: "a", Timeout: 1500 * time.Millisecond, Targets: []string{"b", "c"}, Name: "load", Payload: []byte("x")}
+	var got, err = decodeQueryRequest(encodeQueryRequest(req)[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 7 || got.From != "a" || got.Timeout != req.Timeout || len(got.Targets) != 2 || got.Name != "load" || string(got.Payload) != "x" {
+		t.Errorf("unexpected request %+v", got)
+	}
+	if !got.targeted("c") || got.targeted("d") || !(&queryRequest{}).targeted("d") {
+		t.Error("unexpected targeting")
+	}
+}
+
+func TestQueryCollect(t *testing.T) {
+	var s = NewServer("a", "")
+	s.name = "a"
+	s.ctx = context.Simple()
+	s.sender = newSender(s, nil)
+	for _, name := range []string{"a", "b", "c"} {
+		s.peers[name] = newNode(&memberlist.Node{Name: name, Addr: net.ParseIP("127.0.0.1")})
+	}
+	s.RegisterQuery("load", func(ctx context.Context, from string, payload []byte) ([]byte, error) {
+		return append([]byte("a:"), payload...), nil
+	})
+
+	var ctx, cancel = context.Simple().WithTimeout(200 * time.Millisecond)
+	defer cancel()
+	go func() {
+		// b answers with an error, c never answers
+		time.Sleep(50 * time.Millisecond)
+		var id uint64
+		s.queries.mu.RLock()
+		for id = range s.queries.pending {
+		}
+		s.queries.mu.RUnlock()
+		s.queries.notifyMessage(encodeQueryReply(_QUERY_ACK, id, "c", 0, "", nil))
+		s.queries.notifyMessage(encodeQueryReply(_QUERY_RESPONSE, id, "b", _QUERY_ERR_HANDLER, "overloaded", nil))
+		s.queries.notifyMessage(encodeQueryReply(_QUERY_RESPONSE, id, "x", 0, "", nil))
+	}()
+	var r, err = s.Query(ctx, "load", []byte("?"), WithoutNames("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Targets) != 3 || len(r.Acks) != 3 || len(r.Responses) != 2 {
+		t.Fatalf("unexpected result %+v", r)
+	}
+	for _, resp := range r.Responses {
+		switch resp.From {
+		case "a":
+			if string(resp.Payload) != "a:?" || resp.Err != nil {
+				t.Errorf("unexpected local response %+v", resp)
+			}
+		case "b":
+			var re *RemoteError
+			if !errors.As(resp.Err, &re) || re.Message != "overloaded" {
+				t.Errorf("unexpected remote error %v", resp.Err)
+			}
+		}
+	}
+	if len(r.NoResponse) != 1 || r.NoResponse[0] != "c" {
+		t.Errorf("unexpected non-responders %v", r.NoResponse)
+	}
+
+	if _, err = s.Query(context.Simple(), "load", make([]byte, QuerySizeLimit)); !errors.Is(err, ErrQueryTooLarge) {
+		t.Errorf("large query should be rejected, got %v", err)
+	}
+}
+
+func TestQueryServeErrors(t *testing.T) {
+	var s = NewServer("a", "")
+	s.name = "a"
+	s.ctx = context.Simple()
+	s.sender = newSender(s, nil)
+	s.peers["a"] = newNode(&memberlist.Node{Name: "a"})
+	s.RegisterQuery("panic", func(ctx context.Context, from string, payload []byte) ([]byte, error) {
+		panic("boom")
+	})
+	s.RegisterQuery("fail", func(ctx context.Context, from string, payload []byte) ([]byte, error) {
+		return nil, ErrUnknownQuery
+	})
+
+	var ctx, cancel = context.Simple().WithTimeout(time.Second)
+	defer cancel()
+	var re *RemoteError
+	for _, name := range []string{"panic", "fail", "missing"} {
+		var r, err = s.Query(ctx, name, nil)
+		if err != nil || len(r.Responses) != 1 {
+			t.Fatalf("unexpected result of %s %+v, %v", name, r, err)
+		}
+		var rerr = r.Responses[0].Err
+		switch name {
+		case "missing":
+			if rerr != ErrUnknownQuery {
+				t.Errorf("expect ErrUnknownQuery, got %v", rerr)
+			}
+		default:
+			// the error of handler is never taken as unknown query, even with the same message
+			if !errors.As(rerr, &re) {
+				t.Errorf("expect remote error of %s, got %v", name, rerr)
+			}
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package gossip
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// TagWeight is the well known tag key of node weight in ring, default is 1, 0 means excluded,
+// the weight larger than MaxRingWeight is taken as MaxRingWeight
+const TagWeight = "weight"
+
+// MaxRingWeight is the max weight of node in ring
+const MaxRingWeight = 100
+
+// _RING_MAX_POINTS 每个节点虚拟节点数的上限，避免VirtualNodes过大时重建耗尽内存
+const _RING_MAX_POINTS = 1 << 16
+
+// RingMode is the hashing algorithm of ring
+type RingMode int
+
+const (
+	// RingConsistent is consistent hashing with virtual nodes
+	RingConsistent RingMode = iota
+	// RingRendezvous is weighted rendezvous (highest random weight) hashing
+	RingRendezvous
+)
+
+// RingOptions is the options of ring
+type RingOptions struct {
+	Mode RingMode
+	// VirtualNodes is the number of virtual nodes per weight, default 128,
+	// at most 65536 virtual nodes per node
+	VirtualNodes int
+	// WeightTag is the tag key of node weight, default TagWeight
+	WeightTag string
+	// Filter select the eligible nodes, all nodes are eligible if nil
+	Filter PeerFilter
+}
+
+// RangeChange means the keys whose hash in (Start, End] changed owner from From to To,
+// Start > End means the range wraps around
+type RangeChange struct {
+	Start uint64
+	End   uint64
+	From  string
+	To    string
+}
+
+// OwnershipChange is notified after the ring rebuilt
+type OwnershipChange struct {
+	Joined []string
+	Left   []string
+	// Reweighted is the nodes whose weight changed
+	Reweighted []string
+	// Ranges is only available in RingConsistent mode,
+	// in RingRendezvous mode, owners should recheck their keys
+	Ranges []RangeChange
+}
+
+// RingWatcher is called after ownership changed
+type RingWatcher func(OwnershipChange)
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+type ringState struct {
+	points  []ringPoint       // 按hash排序的虚拟节点，仅consistent模式
+	weights map[string]uint64 // 参与的节点及其权重
+}
+
+// Ring is a hash ring driven by gossip membership automatically
+type Ring struct {
+	srv    *Server
+	opts   RingOptions
+	cancel func()
+	// 成员变更的回调在memberlist的goroutine中执行，所以只发出信号，由后台重建，期间的多次变更合并为一次
+	kick chan struct{}
+	done chan struct{}
+	once sync.Once
+
+	// 保证重建串行进行，避免旧状态覆盖新状态
+	bmu sync.Mutex
+
+	mu       sync.RWMutex
+	state    *ringState
+	watchers []RingWatcher
+}
+
+// NewRing return a ring built from the current membership of server,
+// it will be rebuilt in background automatically while membership changing
+func NewRing(srv *Server, opts RingOptions) *Ring {
+	if opts.VirtualNodes <= 0 {
+		opts.VirtualNodes = 128
+	} else if opts.VirtualNodes > _RING_MAX_POINTS {
+		opts.VirtualNodes = _RING_MAX_POINTS
+	}
+	if opts.WeightTag == "" {
+		opts.WeightTag = TagWeight
+	}
+	var r = &Ring{
+		srv:   srv,
+		opts:  opts,
+		state: &ringState{weights: map[string]uint64{}},
+		kick:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	r.rebuild()
+	r.cancel = srv.watchMembers(r.schedule)
+	go r.loop()
+	return r
+}
+
+// Close stop following the membership
+func (r *Ring) Close() {
+	r.once.Do(func() {
+		r.cancel()
+		close(r.done)
+	})
+}
+
+func (r *Ring) schedule() {
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Ring) loop() {
+	for {
+		select {
+		case <-r.kick:
+			r.rebuild()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// Watch register a watcher of ownership change
+func (r *Ring) Watch(w RingWatcher) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.watchers = append(r.watchers, w)
+}
+
+// Nodes return the names of nodes in ring, ordered by name
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var names = make([]string, 0, len(r.state.weights))
+	for name := range r.state.weights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Owner return the node name which owns the key, empty if ring is empty
+func (r *Ring) Owner(key string) string {
+	var owners = r.Owners(key, 1)
+	if len(owners) == 0 {
+		return ""
+	}
+	return owners[0]
+}
+
+// Owners return n distinct nodes for the key in preference order, used for replicas
+func (r *Ring) Owners(key string, n int) []string {
+	r.mu.RLock()
+	var st = r.state
+	r.mu.RUnlock()
+	if n > len(st.weights) {
+		n = len(st.weights)
+	}
+	if n <= 0 {
+		return nil
+	}
+	if r.opts.Mode == RingRendezvous {
+		return st.rendezvous(key, n)
+	}
+	return st.consistent(RingHash(key), n)
+}
+
+// RingHash is the hash function of keys used by ring
+func RingHash(key string) uint64 {
+	var h = fnv.New64a()
+	h.Write([]byte(key))
+	return mix64(h.Sum64())
+}
+
+// mix64 让fnv的输出分布更均匀(splitmix64 finalizer)
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (st *ringState) successor(h uint64) int {
+	var i = sort.Search(len(st.points), func(i int) bool {
+		return st.points[i].hash >= h
+	})
+	if i == len(st.points) {
+		i = 0
+	}
+	return i
+}
+
+func (st *ringState) consistent(h uint64, n int) []string {
+	var owners = make([]string, 0, n)
+	var seen = make(map[string]bool, n)
+	for i, start := 0, st.successor(h); i < len(st.points) && len(owners) < n; i++ {
+		var p = st.points[(start+i)%len(st.points)]
+		if !seen[p.node] {
+			seen[p.node] = true
+			owners = append(owners, p.node)
+		}
+	}
+	return owners
+}
+
+func (st *ringState) rendezvous(key string, n int) []string {
+	type score struct {
+		node  string
+		score float64
+	}
+	var scores = make([]score, 0, len(st.weights))
+	for node, w := range st.weights {
+		// 加权rendezvous：score = -w / ln(u)，u均匀分布于(0, 1)
+		var u = (float64(RingHash(node+"\x00"+key)>>11) + 0.5) / (1 << 53)
+		scores = append(scores, score{node, -float64(w) / math.Log(u)})
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].score != scores[j].score {
+			return scores[i].score > scores[j].score
+		}
+		return scores[i].node < scores[j].node
+	})
+	var owners = make([]string, n)
+	for i := range owners {
+		owners[i] = scores[i].node
+	}
+	return owners
+}
+
+func (r *Ring) weight(n *Node) uint64 {
+	var v, ok = n.Tags()[r.opts.WeightTag]
+	if !ok {
+		return 1
+	}
+	var w, err = strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 1
+	}
+	if w > MaxRingWeight {
+		return MaxRingWeight
+	}
+	return w
+}
+
+func (r *Ring) build() *ringState {
+	var st = &ringState{weights: make(map[string]uint64)}
+	for _, n := range r.srv.Select(r.opts.Filter) {
+		if w := r.weight(n); w > 0 {
+			st.weights[n.Name] = w
+		}
+	}
+	if r.opts.Mode == RingConsistent {
+		for name, w := range st.weights {
+			var n = w * uint64(r.opts.VirtualNodes)
+			if n > _RING_MAX_POINTS {
+				n = _RING_MAX_POINTS
+			}
+			for i := 0; i < int(n); i++ {
+				st.points = append(st.points, ringPoint{RingHash(name + "#" + strconv.Itoa(i)), name})
+			}
+		}
+		sort.Slice(st.points, func(i, j int) bool {
+			if st.points[i].hash != st.points[j].hash {
+				return st.points[i].hash < st.points[j].hash
+			}
+			return st.points[i].node < st.points[j].node
+		})
+	}
+	return st
+}
+
+func (r *Ring) rebuild() {
+	r.bmu.Lock()
+	defer r.bmu.Unlock()
+	var st = r.build()
+
+	r.mu.Lock()
+	var old = r.state
+	r.state = st
+	var watchers = r.watchers
+	r.mu.Unlock()
+
+	var change = diffRing(old, st)
+	if len(change.Joined) == 0 && len(change.Left) == 0 && len(change.Reweighted) == 0 && len(change.Ranges) == 0 {
+		return
+	}
+	for _, w := range watchers {
+		w(change)
+	}
+}
+
+func diffRing(old, cur *ringState) OwnershipChange {
+	var change OwnershipChange
+	for name, w := range cur.weights {
+		if ow, ok := old.weights[name]; !ok {
+			change.Joined = append(change.Joined, name)
+		} else if ow != w {
+			change.Reweighted = append(change.Reweighted, name)
+		}
+	}
+	for name := range old.weights {
+		if _, ok := cur.weights[name]; !ok {
+			change.Left = append(change.Left, name)
+		}
+	}
+	sort.Strings(change.Joined)
+	sort.Strings(change.Left)
+	sort.Strings(change.Reweighted)
+	change.Ranges = diffRanges(old, cur)
+	return change
+}
+
+// diffRanges 以两个环上所有虚拟节点为边界切分hash空间，逐段比较归属
+func diffRanges(old, cur *ringState) []RangeChange {
+	if len(old.points) == 0 && len(cur.points) == 0 {
+		return nil
+	}
+	var bounds = make([]uint64, 0, len(old.points)+len(cur.points))
+	for _, p := range old.points {
+		bounds = append(bounds, p.hash)
+	}
+	for _, p := range cur.points {
+		bounds = append(bounds, p.hash)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+
+	var owner = func(st *ringState, h uint64) string {
+		if len(st.points) == 0 {
+			return ""
+		}
+		return st.points[st.successor(h)].node
+	}
+
+	var changes []RangeChange
+	for i, end := range bounds {
+		var start = bounds[(i+len(bounds)-1)%len(bounds)]
+		if start == end && len(bounds) > 1 {
+			continue
+		}
+		var from, to = owner(old, end), owner(cur, end)
+		if from == to {
+			continue
+		}
+		if n := len(changes); n > 0 && changes[n-1].End == start && changes[n-1].From == from && changes[n-1].To == to {
+			changes[n-1].End = end
+			continue
+		}
+		changes = append(changes, RangeChange{Start: start, End: end, From: from, To: to})
+	}
+	return changes
+}
@@ -0,0 +1,126 @@
+package gossip
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func TestRingConsistent(t *testing.T) {
+	var s = NewServer("a", "")
+	for _, name := range []string{"a", "b", "c"} {
+		s.nodeOnline(newNode(&memberlist.Node{Name: name}))
+	}
+	var ring = NewRing(s, RingOptions{VirtualNodes: 64})
+	defer ring.Close()
+
+	var owners = make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		var key = strconv.Itoa(i)
+		owners[key] = ring.Owner(key)
+	}
+
+	var changes = make(chan OwnershipChange, 4)
+	ring.Watch(func(c OwnershipChange) {
+		changes <- c
+	})
+	s.nodeOnline(newNode(&memberlist.Node{Name: "d"}))
+
+	var change = waitRingChange(t, changes)
+	if len(change.Joined) != 1 || change.Joined[0] != "d" {
+		t.Fatalf("unexpected change %+v", change)
+	}
+	var inRange = func(h uint64, r RangeChange) bool {
+		if r.Start < r.End {
+			return h > r.Start && h <= r.End
+		}
+		return h > r.Start || h <= r.End
+	}
+	var moved int
+	for key, old := range owners {
+		var cur = ring.Owner(key)
+		if cur == old {
+			continue
+		}
+		moved++
+		if cur != "d" {
+			t.Errorf("key %s should only move to the new node, got %s", key, cur)
+		}
+		var found bool
+		for _, r := range change.Ranges {
+			if inRange(RingHash(key), r) && r.From == old && r.To == cur {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("moved key %s is not covered by range changes", key)
+		}
+	}
+	if moved == 0 || moved > 500 {
+		t.Errorf("unexpected number of moved keys %d", moved)
+	}
+
+	if owners := ring.Owners("x", 5); len(owners) != 4 {
+		t.Errorf("expect 4 distinct owners, got %v", owners)
+	}
+}
+
+func TestRingRendezvousWeight(t *testing.T) {
+	var s = NewServer("a", "")
+	s.nodeOnline(newNode(&memberlist.Node{Name: "a", Meta: encodeMeta(nodeMeta{tags: Tags{TagWeight: "3"}})}))
+	s.nodeOnline(newNode(&memberlist.Node{Name: "b"}))
+	s.nodeOnline(newNode(&memberlist.Node{Name: "c", Meta: encodeMeta(nodeMeta{tags: Tags{TagWeight: "0"}})}))
+	var ring = NewRing(s, RingOptions{Mode: RingRendezvous})
+	defer ring.Close()
+
+	if nodes := ring.Nodes(); len(nodes) != 2 {
+		t.Fatalf("zero weight node should be excluded, got %v", nodes)
+	}
+	var count = make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		count[ring.Owner(strconv.Itoa(i))]++
+	}
+	if count["a"] < 2*count["b"] {
+		t.Errorf("weighted node should own more keys, got %v", count)
+	}
+
+	var changes = make(chan OwnershipChange, 4)
+	ring.Watch(func(c OwnershipChange) {
+		changes <- c
+	})
+	s.nodeOffline(s.Peer("b"))
+	if left := waitRingChange(t, changes).Left; len(left) != 1 || left[0] != "b" || ring.Owner("x") != "a" {
+		t.Errorf("unexpected ring after leaving, left %v", left)
+	}
+}
+
+func TestRingWeightLimit(t *testing.T) {
+	var s = NewServer("a", "")
+	s.nodeOnline(newNode(&memberlist.Node{Name: "a", Meta: encodeMeta(nodeMeta{tags: Tags{TagWeight: "4294967295"}})}))
+	var ring = NewRing(s, RingOptions{VirtualNodes: 1 << 30})
+	defer ring.Close()
+
+	ring.mu.RLock()
+	defer ring.mu.RUnlock()
+	if w := ring.state.weights["a"]; w != MaxRingWeight {
+		t.Errorf("weight should be clamped, got %d", w)
+	}
+	if n := len(ring.state.points); n != _RING_MAX_POINTS {
+		t.Errorf("virtual nodes should be clamped, got %d", n)
+	}
+}
+
+// waitRingChange 环在后台重建
+func waitRingChange(t *testing.T, changes <-chan OwnershipChange) OwnershipChange {
+	t.Helper()
+	select {
+	case c := <-changes:
+		return c
+	case <-time.After(time.Second):
+		t.Fatal("ring is not rebuilt")
+	}
+	return OwnershipChange{}
+}
@@ -0,0 +1,231 @@
+package gossip
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cjey/gbase/context"
+)
+
+var (
+	// ErrUnknownNode means the target node is not a member of the cluster
+	ErrUnknownNode = errors.New("unknown node")
+	// ErrUnknownMethod means the target node did not register the method
+	ErrUnknownMethod = errors.New("unknown method")
+	// ErrRPCTimeout means no response received before deadline
+	ErrRPCTimeout = errors.New("rpc timeout")
+)
+
+// RemoteError is returned by Call when the remote handler failed
+type RemoteError struct {
+	Node    string
+	Method  string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("rpc %s on %s failed, %s", e.Method, e.Node, e.Message)
+}
+
+// RPCHandler handle the request from the given node, ctx has the deadline of caller
+type RPCHandler func(ctx context.Context, from string, req []byte) (resp []byte, err error)
+
+const (
+	_RPC_REQUEST  = 1
+	_RPC_RESPONSE = 2
+
+	// 远端返回的错误码
+	_RPC_ERR_HANDLER = 1
+	_RPC_ERR_METHOD  = 2
+)
+
+type rpcMessage struct {
+	Type    int    `json:"t"`
+	ID      uint64 `json:"id"`
+	From    string `json:"f"`
+	Method  string `json:"m,omitempty"`
+	Timeout int64  `json:"to,omitempty"` // 请求剩余的超时时间，单位毫秒
+	Body    []byte `json:"b,omitempty"`
+	ErrCode int    `json:"ec,omitempty"`
+	Err     string `json:"e,omitempty"`
+}
+
+// RPC is a request/response facility over the reliable channel of gossip
+type RPC struct {
+	srv *Server
+	seq uint64
+	// transmit 发送编码好的rpc消息，测试时替换
+	transmit func(name string, msg []byte) error
+
+	mu      sync.RWMutex
+	methods map[string]RPCHandler
+	pending map[uint64]chan *rpcMessage
+}
+
+func newRPC(srv *Server) *RPC {
+	var r = &RPC{
+		srv:     srv,
+		methods: make(map[string]RPCHandler),
+		pending: make(map[uint64]chan *rpcMessage),
+	}
+	r.transmit = func(name string, msg []byte) error {
+		var sender = srv.currentSender()
+		if sender == nil {
+			return ErrNotRunning
+		}
+		return sender.sendRaw(name, encodeMessage(kindRPC, msg), true)
+	}
+	return r
+}
+
+// RPC return the rpc facility of server
+func (s *Server) RPC() *RPC {
+	return s.rpc
+}
+
+// Register register a named method, it could be called before or after serving
+func (r *RPC) Register(method string, h RPCHandler) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.methods[method]; ok {
+		return fmt.Errorf("rpc method %s already registered", method)
+	}
+	r.methods[method] = h
+	return nil
+}
+
+// Call invoke the method on the given node and wait for the response.
+// If ctx has no deadline, Config.TCPTimeout will be used.
+func (r *RPC) Call(ctx context.Context, name, method string, req []byte) ([]byte, error) {
+	if r.srv.currentSender() == nil {
+		return nil, ErrNotRunning
+	}
+	if r.srv.Peer(name) == nil {
+		return nil, ErrUnknownNode
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = ctx.WithTimeout(r.srv.Config.TCPTimeout)
+		defer cancel()
+	}
+	var deadline, _ = ctx.Deadline()
+	// 超时以毫秒传递，不足1毫秒时对方会立即超时，不如直接失败
+	var timeout = time.Until(deadline)
+	if timeout < time.Millisecond {
+		return nil, ErrRPCTimeout
+	}
+
+	var id = atomic.AddUint64(&r.seq, 1)
+	var ch = make(chan *rpcMessage, 1)
+	r.mu.Lock()
+	r.pending[id] = ch
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, id)
+		r.mu.Unlock()
+	}()
+
+	var err = r.send(name, &rpcMessage{
+		Type:    _RPC_REQUEST,
+		ID:      id,
+		From:    r.srv.localName(),
+		Method:  method,
+		Timeout: int64(timeout / time.Millisecond),
+		Body:    req,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		switch resp.ErrCode {
+		case 0:
+			return resp.Body, nil
+		case _RPC_ERR_METHOD:
+			return nil, ErrUnknownMethod
+		default:
+			return nil, &RemoteError{Node: name, Method: method, Message: resp.Err}
+		}
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrRPCTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (r *RPC) send(name string, m *rpcMessage) error {
+	var buf, err = json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return r.transmit(name, buf)
+}
+
+func (r *RPC) notifyMessage(msg []byte) {
+	var m = new(rpcMessage)
+	if err := json.Unmarshal(msg, m); err != nil {
+		return
+	}
+	switch m.Type {
+	case _RPC_REQUEST:
+		// 不能阻塞memberlist的消息处理协程
+		go r.serve(m)
+	case _RPC_RESPONSE:
+		r.mu.RLock()
+		var ch = r.pending[m.ID]
+		r.mu.RUnlock()
+		if ch != nil {
+			select {
+			case ch <- m:
+			default:
+			}
+		}
+	}
+}
+
+// call 执行handler，handler的panic作为错误返回给调用方
+func (r *RPC) call(h RPCHandler, req *rpcMessage) (resp []byte, err error) {
+	var ctx, cancel = r.srv.ctx.ForkAt("RPC").WithTimeout(time.Duration(req.Timeout) * time.Millisecond)
+	defer cancel()
+	err = safeCall(ctx, "RPC", func() (err error) {
+		resp, err = h(ctx, req.From, req.Body)
+		return err
+	}, "method", req.Method, "from", req.From)
+	return resp, err
+}
+
+func (r *RPC) serve(req *rpcMessage) {
+	var resp = &rpcMessage{
+		Type: _RPC_RESPONSE,
+		ID:   req.ID,
+		From: r.srv.localName(),
+	}
+
+	r.mu.RLock()
+	var h = r.methods[req.Method]
+	r.mu.RUnlock()
+
+	if h == nil {
+		resp.ErrCode = _RPC_ERR_METHOD
+	} else {
+		var body, err = r.call(h, req)
+		if err != nil {
+			resp.ErrCode = _RPC_ERR_HANDLER
+			resp.Err = err.Error()
+		} else {
+			resp.Body = body
+		}
+	}
+
+	if err := r.send(req.From, resp); err != nil {
+		r.srv.ctx.Warn("Unavailable to send rpc response", "err", err, "node", req.From, "method", req.Method)
+	}
+}
@@ -0,0 +1,81 @@
+package gossip
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+
+	"github.com/cjey/gbase/context"
+)
+
+// rpcPair 两个节点的rpc直接相连
+func rpcPair() (*Server, *Server) {
+	var a, b = NewServer("a", ""), NewServer("b", "")
+	for _, s := range []*Server{a, b} {
+		s.ctx = context.Simple()
+		s.sender = newSender(s, nil)
+	}
+	a.name, b.name = "a", "b"
+	a.peers["b"] = newNode(&memberlist.Node{Name: "b"})
+	b.peers["a"] = newNode(&memberlist.Node{Name: "a"})
+	a.rpc.transmit = func(name string, msg []byte) error {
+		go b.rpc.notifyMessage(msg)
+		return nil
+	}
+	b.rpc.transmit = func(name string, msg []byte) error {
+		go a.rpc.notifyMessage(msg)
+		return nil
+	}
+	return a, b
+}
+
+func TestRPCCall(t *testing.T) {
+	var a, b = rpcPair()
+	b.RPC().Register("echo", func(ctx context.Context, from string, req []byte) ([]byte, error) {
+		return append([]byte(from+":"), req...), nil
+	})
+	b.RPC().Register("fail", func(ctx context.Context, from string, req []byte) ([]byte, error) {
+		return nil, errors.New("out of stock")
+	})
+	b.RPC().Register("panic", func(ctx context.Context, from string, req []byte) ([]byte, error) {
+		panic("boom")
+	})
+	b.RPC().Register("slow", func(ctx context.Context, from string, req []byte) ([]byte, error) {
+		// answer after the deadline of caller
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		return nil, ctx.Err()
+	})
+	if err := b.RPC().Register("echo", nil); err == nil {
+		t.Error("duplicated method should be rejected")
+	}
+
+	var ctx = context.Simple()
+	if resp, err := a.RPC().Call(ctx, "b", "echo", []byte("hi")); err != nil || string(resp) != "a:hi" {
+		t.Errorf("unexpected response %q, %v", resp, err)
+	}
+	if _, err := a.RPC().Call(ctx, "b", "missing", nil); err != ErrUnknownMethod {
+		t.Errorf("expect ErrUnknownMethod, got %v", err)
+	}
+	var re *RemoteError
+	if _, err := a.RPC().Call(ctx, "b", "fail", nil); !errors.As(err, &re) || re.Node != "b" || re.Message != "out of stock" {
+		t.Errorf("expect remote error, got %v", err)
+	}
+	if _, err := a.RPC().Call(ctx, "b", "panic", nil); !errors.As(err, &re) || re.Method != "panic" {
+		t.Errorf("panic should be returned as remote error, got %v", err)
+	}
+
+	var tctx, cancel = ctx.WithTimeout(50 * time.Millisecond)
+	defer cancel()
+	if _, err := a.RPC().Call(tctx, "b", "slow", nil); err != ErrRPCTimeout {
+		t.Errorf("expect ErrRPCTimeout, got %v", err)
+	}
+	// less than 1ms left is rejected locally
+	var sctx, scancel = ctx.WithTimeout(500 * time.Microsecond)
+	defer scancel()
+	if _, err := a.RPC().Call(sctx, "b", "echo", nil); err != ErrRPCTimeout {
+		t.Errorf("expect ErrRPCTimeout, got %v", err)
+	}
+}
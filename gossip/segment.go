@@ -0,0 +1,131 @@
+package gossip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// ErrSegmentMismatch means the peer does not belong to the same cluster segment
+var ErrSegmentMismatch = errors.New("segment mismatch")
+
+// Segment is the identity of cluster, nodes with different segment never join each other,
+// e.g. staging and production pools sharing the same network and key
+type Segment struct {
+	// Cluster is the cluster name, advertised in metadata and must be equal
+	Cluster string
+	// Protocol is the application protocol version, advertised in metadata and must be equal
+	Protocol uint32
+	// AllowCIDRs restrict the address of peers, allow all if empty
+	AllowCIDRs []*net.IPNet
+	// AllowTags restrict peers must have all these tags with the same value, allow all if empty
+	AllowTags Tags
+}
+
+// ParseCIDRs parse the CIDR list for Segment.AllowCIDRs
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	var nets = make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		var _, n, err = net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// check 检查节点是否属于本segment，返回拒绝的原因
+func (sg *Segment) check(node *Node) error {
+	if node.cluster != sg.Cluster {
+		return fmt.Errorf("%w, cluster %q, expected %q", ErrSegmentMismatch, node.cluster, sg.Cluster)
+	}
+	if node.protocol != sg.Protocol {
+		return fmt.Errorf("%w, protocol %d, expected %d", ErrSegmentMismatch, node.protocol, sg.Protocol)
+	}
+	if len(sg.AllowCIDRs) > 0 {
+		var allowed = false
+		for _, n := range sg.AllowCIDRs {
+			if n.Contains(node.Addr) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w, address %s not allowed", ErrSegmentMismatch, node.Addr)
+		}
+	}
+	for k, v := range sg.AllowTags {
+		if got, ok := node.tags[k]; !ok || got != v {
+			return fmt.Errorf("%w, tag %s=%q, expected %q", ErrSegmentMismatch, k, got, v)
+		}
+	}
+	return nil
+}
+
+// Cluster return the cluster name advertised by the node
+func (n *Node) Cluster() string {
+	return n.cluster
+}
+
+// Protocol return the application protocol version advertised by the node
+func (n *Node) Protocol() uint32 {
+	return n.protocol
+}
+
+// _REJECT_LOG_INTERVAL 同一个节点的拒绝日志的最小间隔，alive广播会反复到达
+const _REJECT_LOG_INTERVAL = time.Minute
+
+type segmentGuard struct {
+	rejected uint64
+
+	mu     sync.Mutex
+	logged map[string]time.Time
+}
+
+func newSegmentGuard() *segmentGuard {
+	return &segmentGuard{logged: make(map[string]time.Time)}
+}
+
+// Rejected return the number of alive and merge messages rejected by segment
+func (s *Server) Rejected() uint64 {
+	return atomic.LoadUint64(&s.guard.rejected)
+}
+
+// admit 检查节点是否允许加入，本地节点总是允许
+func (s *Server) admit(peer *memberlist.Node) error {
+	if peer.Name == s.localName() {
+		return nil
+	}
+	var node = newNode(peer)
+	var err = s.Segment.check(node)
+	if err == nil {
+		return nil
+	}
+	s.count(&s.guard.rejected, "gossip.segment.rejected", 1)
+
+	var g = s.guard
+	var now = time.Now()
+	g.mu.Lock()
+	var last, ok = g.logged[node.Name]
+	if !ok || now.Sub(last) >= _REJECT_LOG_INTERVAL {
+		g.logged[node.Name] = now
+		ok = false
+	}
+	// 顺便清理过期的记录
+	for name, t := range g.logged {
+		if now.Sub(t) >= _REJECT_LOG_INTERVAL {
+			delete(g.logged, name)
+		}
+	}
+	g.mu.Unlock()
+	if !ok && s.ctx != nil {
+		s.ctx.Warn("Reject node by segment", "node", node.String(), "err", err)
+	}
+	return err
+}
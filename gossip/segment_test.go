@@ -0,0 +1,54 @@
+package gossip
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func TestSegmentCheck(t *testing.T) {
+	var cidrs, err = ParseCIDRs("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sg = Segment{Cluster: "prod", Protocol: 2, AllowCIDRs: cidrs, AllowTags: Tags{"env": "prod"}}
+	var node = func(addr string, m nodeMeta) *Node {
+		return newNode(&memberlist.Node{Name: "x", Addr: net.ParseIP(addr), Meta: encodeMeta(m)})
+	}
+
+	var ok = nodeMeta{cluster: "prod", protocol: 2, tags: Tags{"env": "prod", "role": "api"}}
+	if err := sg.check(node("10.1.2.3", ok)); err != nil {
+		t.Errorf("node should be admitted, %v", err)
+	}
+	var cases = map[string]*Node{
+		"cluster":  node("10.1.2.3", nodeMeta{cluster: "staging", protocol: 2, tags: ok.tags}),
+		"protocol": node("10.1.2.3", nodeMeta{cluster: "prod", protocol: 1, tags: ok.tags}),
+		"cidr":     node("192.168.1.1", ok),
+		"tag":      node("10.1.2.3", nodeMeta{cluster: "prod", protocol: 2}),
+		"legacy":   newNode(&memberlist.Node{Name: "x", Addr: net.ParseIP("10.1.2.3"), Meta: []byte(metaMagic + "\x01\x00")}),
+	}
+	for name, n := range cases {
+		if err := sg.check(n); !errors.Is(err, ErrSegmentMismatch) {
+			t.Errorf("%s mismatch should be rejected, got %v", name, err)
+		}
+	}
+}
+
+func TestSegmentAdmit(t *testing.T) {
+	var s = NewServer("a", "")
+	s.name = "a"
+	s.Segment.Cluster = "prod"
+	if err := s.admit(&memberlist.Node{Name: "a"}); err != nil {
+		t.Errorf("local node should always be admitted, %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.admit(&memberlist.Node{Name: "b", Meta: encodeMeta(nodeMeta{cluster: "staging"})}); err == nil {
+			t.Error("node of other cluster should be rejected")
+		}
+	}
+	if s.Rejected() != 3 {
+		t.Errorf("expect 3 rejected, got %d", s.Rejected())
+	}
+}
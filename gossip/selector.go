@@ -0,0 +1,139 @@
+package gossip
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// well known tag keys
+const (
+	TagRole = "role"
+	TagZone = "zone"
+)
+
+// PeerFilter return true if the node should be selected
+type PeerFilter func(*Node) bool
+
+// WithTag select the nodes which have the tag with the given value
+func WithTag(key, value string) PeerFilter {
+	return func(n *Node) bool {
+		var v, ok = n.tags[key]
+		return ok && v == value
+	}
+}
+
+// WithRole select the nodes of the role
+func WithRole(role string) PeerFilter {
+	return WithTag(TagRole, role)
+}
+
+// WithZone select the nodes in the zone
+func WithZone(zone string) PeerFilter {
+	return WithTag(TagZone, zone)
+}
+
+// WithoutNames exclude the nodes of the given names
+func WithoutNames(names ...string) PeerFilter {
+	var m = make(map[string]bool, len(names))
+	for _, name := range names {
+		m[name] = true
+	}
+	return func(n *Node) bool {
+		return !m[n.Name]
+	}
+}
+
+// WithRTT select the nodes whose rtt is measured
+func WithRTT() PeerFilter {
+	return func(n *Node) bool {
+		return n.RTT >= 0
+	}
+}
+
+func matchAll(n *Node, filters []PeerFilter) bool {
+	for _, f := range filters {
+		if f != nil && !f(n) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectLocked 必须持有pmu读锁
+func (s *Server) selectLocked(filters []PeerFilter) []*Node {
+	var nodes = make([]*Node, 0, len(s.peers))
+	for _, p := range s.peers {
+		if matchAll(p, filters) {
+			nodes = append(nodes, p)
+		}
+	}
+	return nodes
+}
+
+// Select return the peers matching all filters, ordered by name
+func (s *Server) Select(filters ...PeerFilter) []*Node {
+	s.pmu.RLock()
+	defer s.pmu.RUnlock()
+	var nodes = s.selectLocked(filters)
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+	return nodes
+}
+
+// Others is same as Select, but exclude local node
+func (s *Server) Others(filters ...PeerFilter) []*Node {
+	return s.Select(append(filters[:len(filters):len(filters)], WithoutNames(s.localName()))...)
+}
+
+// SelectByRTT return the peers matching all filters, ordered by rtt,
+// the nodes whose rtt is unknown are at the end
+func (s *Server) SelectByRTT(filters ...PeerFilter) []*Node {
+	s.pmu.RLock()
+	defer s.pmu.RUnlock()
+	var nodes = s.selectLocked(filters)
+	sort.Slice(nodes, func(i, j int) bool {
+		var a, b = nodes[i].RTT, nodes[j].RTT
+		if (a < 0) != (b < 0) {
+			return a >= 0
+		}
+		if a != b {
+			return a < b
+		}
+		return nodes[i].Name < nodes[j].Name
+	})
+	return nodes
+}
+
+// RandomPeers pick k random peers matching all filters, local node is excluded, none if k <= 0
+func (s *Server) RandomPeers(k int, filters ...PeerFilter) []*Node {
+	var nodes = s.Others(filters...)
+	rand.Shuffle(len(nodes), func(i, j int) {
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	})
+	if k < 0 {
+		k = 0
+	}
+	if k < len(nodes) {
+		nodes = nodes[:k]
+	}
+	return nodes
+}
+
+// withoutSuspected 排除正在被怀疑的节点，它们的rtt已经不可信
+func (s *Server) withoutSuspected() PeerFilter {
+	return func(n *Node) bool {
+		return !s.suspecters.has(n.Name)
+	}
+}
+
+// NearestPeer return the peer with minimum rtt matching all filters, local node, the nodes
+// whose rtt is unknown and the suspected nodes (see MemberSuspect) are excluded
+func (s *Server) NearestPeer(filters ...PeerFilter) *Node {
+	var nodes = s.SelectByRTT(append(filters[:len(filters):len(filters)],
+		WithoutNames(s.localName()), WithRTT(), s.withoutSuspected())...)
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes[0]
+}
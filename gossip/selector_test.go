@@ -0,0 +1,64 @@
+package gossip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func addTestPeer(s *Server, name string, tags Tags, rtt time.Duration) {
+	var node = newNode(&memberlist.Node{Name: name, Meta: encodeMeta(nodeMeta{tags: tags})})
+	node.RTT = rtt
+	s.peers[name] = node
+}
+
+func TestSelector(t *testing.T) {
+	var s = NewServer("self", "")
+	s.name = "self"
+	addTestPeer(s, "self", Tags{TagRole: "api"}, 0)
+	addTestPeer(s, "a", Tags{TagRole: "api", TagZone: "z1"}, 30*time.Millisecond)
+	addTestPeer(s, "b", Tags{TagRole: "api", TagZone: "z2"}, 10*time.Millisecond)
+	addTestPeer(s, "c", Tags{TagRole: "db", TagZone: "z1"}, -1)
+
+	var names = func(nodes []*Node) (r []string) {
+		for _, n := range nodes {
+			r = append(r, n.Name)
+		}
+		return
+	}
+
+	if got := names(s.Others(WithRole("api"))); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("unexpected api peers %v", got)
+	}
+	if got := names(s.Select(WithZone("z1"))); len(got) != 2 || got[0] != "a" || got[1] != "c" {
+		t.Errorf("unexpected z1 peers %v", got)
+	}
+	if got := names(s.SelectByRTT()); len(got) != 4 || got[0] != "self" || got[1] != "b" || got[3] != "c" {
+		t.Errorf("unexpected rtt order %v", got)
+	}
+	if n := s.NearestPeer(); n == nil || n.Name != "b" {
+		t.Errorf("nearest peer should be b, got %v", n)
+	}
+	if n := s.NearestPeer(WithRole("db")); n != nil {
+		t.Errorf("db peer has no rtt, got %v", n)
+	}
+	// suspected node is not the nearest
+	s.suspecters.set("b", "a")
+	if n := s.NearestPeer(); n == nil || n.Name != "a" {
+		t.Errorf("nearest peer should be a while b suspected, got %v", n)
+	}
+	s.suspecters.take("b")
+
+	if got := s.RandomPeers(-1); len(got) != 0 {
+		t.Errorf("expect no random peers, got %v", names(got))
+	}
+	if got := s.RandomPeers(2); len(got) != 2 {
+		t.Errorf("expect 2 random peers, got %v", names(got))
+	}
+	for _, n := range s.RandomPeers(10) {
+		if n.Name == "self" {
+			t.Error("random peers should exclude self")
+		}
+	}
+}
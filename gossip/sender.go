@@ -8,6 +8,9 @@ import (
 	"github.com/hashicorp/memberlist"
 )
 
+// _PACKET_OVERHEAD memberlist把多条广播合并进一个udp包时的额外开销，包括compound消息头、每条消息的长度，以及加密的版本号、nonce和tag
+const _PACKET_OVERHEAD = 64
+
 type broadcast []byte
 
 func (b broadcast) Invalidates(memberlist.Broadcast) bool {
@@ -26,7 +29,8 @@ type Sender struct {
 	srv *Server
 	dgm *delegateM
 
-	queue *memberlist.TransmitLimitedQueue
+	// 按优先级排列的广播队列
+	lanes []*lane
 }
 
 func newSender(srv *Server, dgm *delegateM) *Sender {
@@ -34,11 +38,7 @@ func newSender(srv *Server, dgm *delegateM) *Sender {
 		srv: srv,
 		dgm: dgm,
 
-		queue: &memberlist.TransmitLimitedQueue{
-			NumNodes: func() int {
-				return 1
-			},
-		},
+		lanes: newLanes(srv),
 	}
 }
 
@@ -46,21 +46,26 @@ func (s *Sender) Self() *Node {
 	if s == nil {
 		return nil
 	}
-	return s.srv.Peer(s.srv.name)
+	return s.srv.Peer(s.srv.localName())
 }
 
 func (s *Sender) Name() string {
 	if s == nil {
 		return ""
 	}
-	return s.srv.name
+	return s.srv.localName()
 }
 
 func (s *Sender) UpdateMetadata(timeout time.Duration) error {
 	if s == nil {
 		return nil
 	}
-	return s.srv.memberlist.UpdateNode(timeout)
+	var ml = s.srv.currentMemberlist()
+	if ml == nil {
+		// 尚未创建，创建时会使用最新的元数据
+		return nil
+	}
+	return ml.UpdateNode(timeout)
 }
 
 func (s *Sender) Ping(name string) (time.Duration, error) {
@@ -73,10 +78,14 @@ func (s *Sender) Ping(name string) (time.Duration, error) {
 	if peer == nil {
 		return 0, fmt.Errorf("no route to host")
 	}
+	var ml = s.srv.currentMemberlist()
+	if ml == nil {
+		return 0, ErrNotRunning
+	}
 	var addr, _ = net.ResolveUDPAddr("udp", peer.Address())
-	var rtt, err = s.srv.memberlist.Ping(peer.Name, addr)
-	if err != nil {
-		peer.RTT = rtt
+	var rtt, err = ml.Ping(peer.Name, addr)
+	if err == nil {
+		s.srv.nodePing(peer, rtt)
 	}
 	return rtt, err
 }
@@ -99,33 +108,100 @@ func (s *Sender) SendBestEffort(name string, msg []byte) {
 	if s == nil {
 		return
 	}
-	s.srv.pmu.RLock()
-	var peer = s.srv.peers[name]
-	s.srv.pmu.RUnlock()
-	if peer != nil {
-		s.srv.memberlist.SendBestEffort(peer.node, msg)
-	}
+	s.sendRaw(name, encodeMessage(kindUser, msg), false)
 }
 
 func (s *Sender) SendReliable(name string, msg []byte) {
 	if s == nil {
 		return
 	}
+	s.sendRaw(name, encodeMessage(kindUser, msg), true)
+}
+
+// fitsPacket 超过预算的广播永远无法被放进udp包，只会在队列中等到被丢弃
+func (s *Sender) fitsPacket(msg []byte) bool {
+	return len(msg) <= s.srv.Config.UDPBufferSize-_PACKET_OVERHEAD
+}
+
+// sendRaw 发送已经编码好的消息
+func (s *Sender) sendRaw(name string, msg []byte, reliable bool) error {
 	s.srv.pmu.RLock()
 	var peer = s.srv.peers[name]
 	s.srv.pmu.RUnlock()
-	if peer != nil {
-		s.srv.memberlist.SendReliable(peer.node, msg)
+	if peer == nil {
+		return ErrUnknownNode
+	}
+	var ml = s.srv.currentMemberlist()
+	if ml == nil {
+		return ErrNotRunning
+	}
+	var err error
+	if reliable {
+		err = ml.SendReliable(peer.node, msg)
+	} else {
+		err = ml.SendBestEffort(peer.node, msg)
+	}
+	if err == nil {
+		s.srv.countSent(msg)
 	}
+	return err
 }
 
+// Broadcast broadcast the msg with PriorityNormal
 func (s *Sender) Broadcast(msg []byte) {
+	s.BroadcastPriority(PriorityNormal, msg)
+}
+
+// BroadcastPriority broadcast the msg in the lane of given priority,
+// return false if it was dropped because the lane is full
+func (s *Sender) BroadcastPriority(p Priority, msg []byte) bool {
 	if s == nil {
-		return
+		return false
 	}
-	s.queue.QueueBroadcast(broadcast(msg))
+	return s.queueBroadcast(p, broadcast(encodeMessage(kindUser, msg)))
 }
 
+// LaneStats return the snapshot of all broadcast lanes
+func (s *Sender) LaneStats() []LaneStats {
+	if s == nil {
+		return nil
+	}
+	var stats = make([]LaneStats, len(s.lanes))
+	for i, l := range s.lanes {
+		stats[i] = l.stats(Priority(i))
+	}
+	return stats
+}
+
+func (s *Sender) queueBroadcast(p Priority, b memberlist.Broadcast) bool {
+	if p < 0 || int(p) >= len(s.lanes) {
+		p = PriorityNormal
+	}
+	if !s.lanes[p].push(b) {
+		return false
+	}
+	s.srv.count(&s.srv.stats.bcQueued, "gossip.broadcast.queued", 1)
+	return true
+}
+
+// getBroadcasts 按优先级从高到低依次取出广播，直到填满limit
 func (s *Sender) getBroadcasts(overhead, limit int) [][]byte {
-	return s.queue.GetBroadcasts(overhead, limit)
+	var msgs [][]byte
+	for _, l := range s.lanes {
+		if limit <= overhead {
+			break
+		}
+		var got = l.pop(overhead, limit)
+		for _, m := range got {
+			limit -= overhead + len(m)
+		}
+		msgs = append(msgs, got...)
+	}
+	if len(msgs) > 0 {
+		s.srv.count(&s.srv.stats.bcSent, "gossip.broadcast.sent", uint64(len(msgs)))
+		for _, m := range msgs {
+			s.srv.countSent(m)
+		}
+	}
+	return msgs
 }
@@ -1,8 +1,6 @@
 package gossip
 
 import (
-	"crypto/sha1"
-	"fmt"
 	"log"
 	"sync"
 	"time"
@@ -13,23 +11,91 @@ import (
 )
 
 type Server struct {
+	// Config is the memberlist config, Serve always installs its own Delegate, Events, Ping, Alive, Merge
+	// and Conflict (use RegisterDelegate or AddDelegate instead), and wraps the Transport to keep it across restarts,
+	// see Overrides for the other settings
 	Config *memberlist.Config
+	// Lanes config the broadcast lanes indexed by Priority, take effect before serving
+	Lanes [_PRIORITY_NUM]LaneConfig
+	// Segment is the cluster identity, peers of other segment are rejected, take effect before serving
+	Segment Segment
+	// ConflictPolicy decide what to do when another node claims the same name, default ConflictReport
+	ConflictPolicy ConflictPolicy
+	// Metrics receive the metrics of server if not nil, take effect before serving
+	Metrics MetricsSink
+	// Overrides is the settings Serve is allowed to override, default OverrideAll
+	Overrides Override
+	// ObserveLog count the encryption errors (see Stats.EncryptionErrors) from the logs of memberlist,
+	// which reports them to no delegate. It relies on the wording of memberlist v0.2.2, and only works with
+	// the logger installed by Serve (see OverrideLogger), default false
+	ObserveLog bool
+	// RemoteKeyring allow other nodes to manage the keys of local node by Keyring().InstallCluster etc,
+	// take effect before serving, default false
+	RemoteKeyring bool
+	// Bootstraps is the static seed addresses (host:port) joined by Start, Serve replaces it by its arguments
+	Bootstraps []string
+	// Discoverer discover seeds periodically in addition to the Bootstraps
+	Discoverer Discoverer
+	// DiscoveryInterval is the interval of discovering seeds, default DefaultDiscoveryInterval
+	DiscoveryInterval time.Duration
+	// SnapshotPath persist the known peers to the file periodically, they are used as seeds on start,
+	// so the node could rejoin even if all Bootstraps are gone, disabled if empty
+	SnapshotPath string
+	// SnapshotInterval is the interval of persisting peers, default DefaultSnapshotInterval
+	SnapshotInterval time.Duration
 
 	name string
-
-	mu      sync.Mutex
+	nmu  sync.RWMutex
+	ctx  context.Context
+	// 是否已经因为名字冲突重命名过
+	renamed int32
+	// 本次运行的启动时间(unix nano)，通过元数据通告
+	started int64
+
+	// mu 串行化启动、停止和重命名
+	mu sync.Mutex
+	// 当前运行周期的状态和信号，每次停止后都会为下一次启动重建ready和shutsig
+	state   State
 	shutsig chan struct{}
+	// memberlist创建完成后关闭
+	ready chan struct{}
+	lmu   sync.RWMutex
+	// Serve安装的logger，重启时需要替换为新context的logger
+	logger *log.Logger
 
+	// memberlist和sender的替换同时持有mu和lmu
 	memberlist *memberlist.Memberlist
 	sender     *Sender
 	delegate   Delegate
+	kv         *KV
+	topics     *topicMux
+	rpc        *RPC
+	keyed      *keyedVersions
+	uevents    *userEvents
+	queries    *queries
+	suspecters *suspecters
+	streams    *streams
+	keyring    *Keyring
+	events     *memberEvents
+	guard      *segmentGuard
+	coords     *vivaldi
+	stats      serverStats
+
+	// 本节点的tags
+	tags Tags
+	tmu  sync.RWMutex
 
 	// key<bootstrap node addr> => value<online>
 	bootstraps map[string]bool
+	bmu        sync.Mutex
 
 	// key<node name> => value<node>
 	peers map[string]*Node
 	pmu   sync.RWMutex
+
+	// 成员变更的内部观察者
+	watchers []*func()
+	wmu      sync.RWMutex
 }
 
 // NewServer return a gossip server, enable lzw compression default
@@ -76,190 +142,244 @@ func NewServer(name, key string) *Server {
 	}
 
 	if key != "" {
-		var hashed = sha1.Sum([]byte("magic=Chaos Is A Ladder&" + key))
-		cfg.SecretKey = hashed[:16] // enable AES-128
+		cfg.SecretKey = DeriveKey(key) // enable AES-128
 	}
 
-	return &Server{
-		Config: cfg,
+	var s = &Server{
+		Config:    cfg,
+		name:      name,
+		Overrides: OverrideAll,
+		Lanes: [_PRIORITY_NUM]LaneConfig{
+			PriorityControl: {MaxDepth: 0},
+			PriorityNormal:  {MaxDepth: 1024, Policy: DropOldest},
+			PriorityBulk:    {MaxDepth: 256, Policy: DropOldest},
+		},
 
 		shutsig:    make(chan struct{}),
+		ready:      make(chan struct{}),
 		bootstraps: make(map[string]bool),
 		peers:      make(map[string]*Node),
+		topics:     newTopicMux(),
+		keyed:      newKeyedVersions(),
+		events:     newMemberEvents(),
+		guard:      newSegmentGuard(),
+		coords:     newVivaldi(),
+		suspecters: newSuspecters(),
 	}
+	s.kv = newKV(s)
+	s.rpc = newRPC(s)
+	s.uevents = newUserEvents(s)
+	s.queries = newQueries(s)
+	s.streams = newStreams(s)
+	s.keyring = newKeyring(s)
+	return s
 }
 
+// KV return the cluster-wide replicated key/value store
+func (s *Server) KV() *KV {
+	return s.kv
+}
+
+// RegisterDelegate set the delegate, it's not allowed while serving, and takes effect at next start
 func (s *Server) RegisterDelegate(d Delegate) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.memberlist != nil {
-		select {
-		case <-s.shutsig:
-			return fmt.Errorf("already shutdown")
-		default:
-			return fmt.Errorf("already serving")
-		}
-	}
-	s.delegate = d
-	return nil
+	return s.setDelegate(d)
 }
 
-func (s *Server) Serve(ctx context.Context, bindstr string, bootstrapsstr ...string) error {
+// AddDelegate compose the delegate with the registered ones by MultiDelegate,
+// so that several libraries could attach to the same server
+func (s *Server) AddDelegate(d Delegate) error {
 	s.mu.Lock()
-	var locked = true
-	var unlock = func() {
-		if locked {
-			locked = false
-			s.mu.Unlock()
-		}
+	defer s.mu.Unlock()
+	switch m := s.delegate.(type) {
+	case nil:
+		return s.setDelegate(d)
+	case *MultiDelegate:
+		return s.setDelegate(NewMultiDelegate(append(m.delegates[:len(m.delegates):len(m.delegates)], d)...))
+	default:
+		return s.setDelegate(NewMultiDelegate(m, d))
 	}
-	defer unlock()
-
-	if s.memberlist != nil {
-		select {
-		case <-s.shutsig:
-			return fmt.Errorf("already shutdown")
-		default:
-			return fmt.Errorf("already serving")
-		}
+}
+
+// setDelegate 调用方必须持有s.mu
+func (s *Server) setDelegate(d Delegate) error {
+	if st := s.State(); st == StateStarting || st == StateRunning {
+		return ErrServing
 	}
+	s.delegate = d
+	return nil
+}
 
+// Serve start the server by Start, and block until it's stopped.
+// bindstr is the bind address, bootstrapsstr replace the Bootstraps.
+func (s *Server) Serve(ctx context.Context, bindstr string, bootstrapsstr ...string) error {
 	// check all address, make bootstraps uniq, and remove bind from bootstraps if it has
 	bind, bootstraps, err := UniqTCPAddr(bindstr, bootstrapsstr)
 	if err != nil {
 		return err
 	}
+
+	s.mu.Lock()
+	if st := s.State(); st == StateStarting || st == StateRunning {
+		s.mu.Unlock()
+		return ErrServing
+	}
+	s.Bootstraps = make([]string, 0, len(bootstraps))
 	for _, addr := range bootstraps {
-		s.bootstraps[addr.String()] = false
+		s.Bootstraps = append(s.Bootstraps, addr.String())
 	}
 
 	// overwrite config
 	var cfg = s.Config
 	cfg.BindAddr = bind.IP.String()
 	cfg.BindPort = bind.Port
-	cfg.AdvertiseAddr = cfg.BindAddr
-	cfg.AdvertisePort = cfg.BindPort
-	cfg.PushPullInterval = 0 // just disable full state sync
-
-	if cfg.Logger == nil {
-		var l = newLogWriter(ctx, _LOG_LEVEL_WARN)
-		cfg.Logger = log.New(l, "", 0)
+	if s.Overrides&OverrideAdvertise != 0 {
+		cfg.AdvertiseAddr = cfg.BindAddr
+		cfg.AdvertisePort = cfg.BindPort
 	}
+	s.mu.Unlock()
 
-	// set delegate
-	var dgm = newDelegateM(s)
-	cfg.Delegate = dgm
-	cfg.Events = dgm
-	cfg.Ping = dgm
-
-	// create server use retry policy
-	var ecnt = 0
-	for {
-		var srv, err = memberlist.Create(cfg)
-		if err == nil {
-			s.name = cfg.Name
-			s.memberlist = srv
-			break
-		}
-		ecnt++
-		if ecnt >= 10 { // total retry 10 times, total wait 45s
-			return fmt.Errorf("gossip server serve failed after creating memberlist 10 times, %w", err)
-		}
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-s.shutsig:
-			return nil
-		case <-time.After(time.Duration(ecnt) * time.Second):
-		}
-	}
-	unlock()
-
-	dgm.start()
-
-	if len(s.bootstraps) > 0 {
-		go s.keepBootstrapsOnline()
+	shutsig, err := s.start(ctx)
+	if err != nil {
+		return err
 	}
 
-	go func() {
-		select {
-		case <-ctx.Done():
-			s.mu.Lock()
-			defer s.mu.Unlock()
-			select {
-			case <-s.shutsig:
-			default:
-				close(s.shutsig)
-			}
-		case <-s.shutsig:
-		}
-	}()
-
 	// wait shutdown signal
-	<-s.shutsig
+	<-shutsig
 	return nil
 }
 
+// Shutdown stop the server like Stop, and also shutdown the custom transport of Config,
+// so the server could not be started again if it depends on the transport
 func (s *Server) Shutdown(ctx context.Context) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	select {
-	case <-s.shutsig:
-		return nil
-	default:
+	var err = s.Stop(ctx)
+	if t, ok := s.Config.Transport.(*sharedTransport); ok {
+		if e := t.Transport.Shutdown(); e != nil {
+			return e
+		}
 	}
+	return err
+}
 
-	defer func() {
-		close(s.shutsig)
-	}()
+// Name return the current name of local node, it changes after renamed by ConflictRename
+func (s *Server) Name() string {
+	return s.localName()
+}
 
-	var timeout = 5 * time.Second
-	if d, ok := ctx.Deadline(); ok {
-		timeout = time.Until(d)
-	}
+// localName 本节点当前的名字，名字冲突时可能被重命名
+func (s *Server) localName() string {
+	s.nmu.RLock()
+	defer s.nmu.RUnlock()
+	return s.name
+}
 
-	// first, broadcast Leave message
-	if err := s.memberlist.Leave(timeout); err != nil {
-		return err
+func (s *Server) setName(name string) {
+	s.nmu.Lock()
+	s.name = name
+	s.nmu.Unlock()
+}
+
+// currentSender 返回当前运行周期的Sender，从未启动过时为nil
+func (s *Server) currentSender() *Sender {
+	s.lmu.RLock()
+	defer s.lmu.RUnlock()
+	return s.sender
+}
+
+// currentMemberlist 重命名时会替换memberlist，未持有s.mu时必须通过它读取，创建之前返回nil
+func (s *Server) currentMemberlist() *memberlist.Memberlist {
+	s.lmu.RLock()
+	defer s.lmu.RUnlock()
+	return s.memberlist
+}
+
+// setMemberlist 调用方必须持有s.mu
+func (s *Server) setMemberlist(ml *memberlist.Memberlist) {
+	s.lmu.Lock()
+	s.memberlist = ml
+	s.lmu.Unlock()
+}
+
+// waitReady 等待memberlist创建完成，如果在此之前已经关闭则返回false
+func (s *Server) waitReady() bool {
+	var ready, shutsig = s.signals()
+	select {
+	case <-ready:
+		return true
+	case <-shutsig:
+		return false
 	}
-	// then shutdown
-	return s.memberlist.Shutdown()
 }
 
 func (s *Server) nodeOnline(node *Node) {
 	var addr = node.Address()
 
+	s.bmu.Lock()
 	if _, ok := s.bootstraps[addr]; ok {
 		// bootstrap node online
 		s.bootstraps[addr] = true
 	}
+	s.bmu.Unlock()
 
-	if node.Name == s.name {
+	if node.Name == s.localName() {
 		node.RTT = 0
 	}
 
 	s.pmu.Lock()
 	s.peers[node.Name] = node
 	s.pmu.Unlock()
+	s.membersChanged()
 }
 
 func (s *Server) nodeOffline(node *Node) {
 	var addr = node.Address()
 
+	s.bmu.Lock()
 	if _, ok := s.bootstraps[addr]; ok {
 		// bootstrap node offline
 		s.bootstraps[addr] = false
 	}
+	s.bmu.Unlock()
 
 	s.pmu.Lock()
 	delete(s.peers, node.Name)
 	s.pmu.Unlock()
+	s.membersChanged()
 }
 
 func (s *Server) nodeUpdate(node *Node) {
 	s.pmu.Lock()
 	s.peers[node.Name] = node
 	s.pmu.Unlock()
+	s.membersChanged()
+}
+
+// watchMembers 注册成员变更的回调，在peers更新之后同步调用，返回取消函数
+func (s *Server) watchMembers(fn func()) (cancel func()) {
+	var w = &fn
+	s.wmu.Lock()
+	s.watchers = append(s.watchers, w)
+	s.wmu.Unlock()
+	return func() {
+		s.wmu.Lock()
+		defer s.wmu.Unlock()
+		for i, x := range s.watchers {
+			if x == w {
+				s.watchers = append(s.watchers[:i:i], s.watchers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (s *Server) membersChanged() {
+	s.wmu.RLock()
+	var watchers = s.watchers
+	s.wmu.RUnlock()
+	for _, w := range watchers {
+		(*w)()
+	}
 }
 
 func (s *Server) nodePing(node *Node, rtt time.Duration) {
@@ -268,6 +388,7 @@ func (s *Server) nodePing(node *Node, rtt time.Duration) {
 		peer.RTT = rtt
 	}
 	s.pmu.Unlock()
+	s.nodeAcked(node)
 }
 
 func (s *Server) Peer(name string) *Node {
@@ -285,23 +406,3 @@ func (s *Server) Peers() []*Node {
 	}
 	return peers
 }
-
-func (s *Server) keepBootstrapsOnline() {
-	for {
-		var offlines = make([]string, 0)
-		for addr, online := range s.bootstraps {
-			if !online {
-				offlines = append(offlines, addr)
-			}
-		}
-		if len(offlines) > 0 {
-			s.memberlist.Join(offlines)
-		}
-
-		select {
-		case <-s.shutsig:
-			return
-		case <-time.After(5 * time.Second):
-		}
-	}
-}
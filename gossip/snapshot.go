@@ -0,0 +1,121 @@
+package gossip
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+
+	"github.com/cjey/gbase/context"
+)
+
+// DefaultSnapshotInterval is the default interval of persisting the known peers
+const DefaultSnapshotInterval = 30 * time.Second
+
+// Snapshot is the known peers persisted by server
+type Snapshot struct {
+	Time  time.Time      `json:"time"`
+	Peers []SnapshotPeer `json:"peers"`
+}
+
+// SnapshotPeer is a peer in snapshot
+type SnapshotPeer struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+	// Meta is the raw metadata announced by the peer, include the segment and tags
+	Meta []byte `json:"meta,omitempty"`
+}
+
+// LoadSnapshot read the snapshot file
+func LoadSnapshot(path string) (*Snapshot, error) {
+	var buf, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var snap = &Snapshot{}
+	if err = json.Unmarshal(buf, snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// saveSnapshot 把已知的其他节点写入SnapshotPath，先写临时文件再改名，避免崩溃时留下不完整的文件
+func (s *Server) saveSnapshot() error {
+	var others = s.Others()
+	if len(others) == 0 {
+		// 孤立时不覆盖，保留之前已知的节点，重启后仍有机会找回集群
+		return nil
+	}
+	var snap = Snapshot{Time: time.Now(), Peers: make([]SnapshotPeer, 0, len(others))}
+	for _, n := range others {
+		var peer = SnapshotPeer{Name: n.Name, Addr: n.Address()}
+		if n.node != nil {
+			peer.Meta = n.node.Meta
+		}
+		snap.Peers = append(snap.Peers, peer)
+	}
+	sort.Slice(snap.Peers, func(i, j int) bool {
+		return snap.Peers[i].Name < snap.Peers[j].Name
+	})
+
+	var buf, err = json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	var tmp = s.SnapshotPath + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.SnapshotPath)
+}
+
+// snapshotSeeds 作为Discoverer使用，快照中不属于本Segment的节点被忽略，快照不存在时不是错误
+func (s *Server) snapshotSeeds(ctx context.Context) ([]string, error) {
+	var snap, err = LoadSnapshot(s.SnapshotPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var seeds = make([]string, 0, len(snap.Peers))
+	for _, p := range snap.Peers {
+		if p.Name == s.localName() {
+			continue
+		}
+		var addr, err = net.ResolveTCPAddr("tcp", p.Addr)
+		if err != nil {
+			continue
+		}
+		var node = newNode(&memberlist.Node{Name: p.Name, Addr: addr.IP, Port: uint16(addr.Port), Meta: p.Meta})
+		if s.Segment.check(node) != nil {
+			continue
+		}
+		seeds = append(seeds, p.Addr)
+	}
+	return seeds, nil
+}
+
+// keepSnapshot 定期保存快照，直到本次运行结束，停止时由stop保存最后一次
+func (s *Server) keepSnapshot(shutsig chan struct{}) {
+	var interval = s.SnapshotInterval
+	if interval <= 0 {
+		interval = DefaultSnapshotInterval
+	}
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutsig:
+			return
+		case <-ticker.C:
+		}
+		if err := s.saveSnapshot(); err != nil {
+			s.ctx.Warn("Save peers snapshot failed", "path", s.SnapshotPath, "err", err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package gossip
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+
+	"github.com/cjey/gbase/context"
+)
+
+func TestSnapshotSeeds(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "gossip-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var path = filepath.Join(dir, "peers.json")
+
+	var node = func(name, addr string, m nodeMeta) *Node {
+		return newNode(&memberlist.Node{Name: name, Addr: net.ParseIP(addr), Port: 7946, Meta: encodeMeta(m)})
+	}
+	var s = NewServer("a", "")
+	s.name = "a"
+	s.SnapshotPath = path
+	s.peers["a"] = node("a", "10.0.0.1", nodeMeta{cluster: "prod"})
+	if err := s.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("isolated node should not overwrite the snapshot")
+	}
+
+	s.peers["b"] = node("b", "10.0.0.2", nodeMeta{cluster: "prod"})
+	s.peers["c"] = node("c", "10.0.0.3", nodeMeta{cluster: "staging"})
+	if err := s.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := LoadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Peers) != 2 || snap.Peers[0].Name != "b" || snap.Peers[1].Addr != "10.0.0.3:7946" {
+		t.Errorf("unexpected snapshot %+v", snap.Peers)
+	}
+
+	// restarted node only use the peers of its segment
+	var r = NewServer("a", "")
+	r.name = "a"
+	r.ctx = context.Simple()
+	r.Segment = Segment{Cluster: "prod"}
+	r.SnapshotPath = path
+	var seeds = r.discoverSeeds("10.0.0.1:7946")
+	if len(seeds) != 1 || seeds[0] != "10.0.0.2:7946" {
+		t.Errorf("unexpected seeds %v", seeds)
+	}
+
+	r.SnapshotPath = filepath.Join(dir, "missing.json")
+	if seeds, err := r.snapshotSeeds(r.ctx); err != nil || len(seeds) != 0 {
+		t.Errorf("missing snapshot should be empty, got %v, %v", seeds, err)
+	}
+}
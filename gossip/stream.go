@@ -0,0 +1,598 @@
+package gossip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/cjey/gbase/context"
+)
+
+var (
+	// ErrUnknownStream means the receiver did not register the stream
+	ErrUnknownStream = errors.New("unknown stream")
+	// ErrStreamChecksum means the payload received is not the same as the one sent
+	ErrStreamChecksum = errors.New("stream checksum mismatch")
+	// ErrStreamAborted means the sender gave up the stream
+	ErrStreamAborted = errors.New("stream aborted")
+	// ErrStreamTimeout means no progress made after retries
+	ErrStreamTimeout = errors.New("stream timeout")
+)
+
+// StreamChunkSize is the max size of each chunk, every chunk is sent as a reliable message
+var StreamChunkSize = 32 * 1024
+
+// StreamWindow is the max number of chunks not yet consumed by the receiver,
+// the sender blocks when the window is full
+var StreamWindow = 8
+
+// StreamHandler read the payload streamed from the given node, r returns io.EOF after the whole payload
+// is received and verified. The sender is slowed down if r is read slowly, and fails if it isn't read
+// for Config.TCPTimeout several times. Returning an error fails the sender with *RemoteError.
+type StreamHandler func(ctx context.Context, from string, r io.Reader) error
+
+// StreamProgress is called with the number of bytes consumed by the receiver
+type StreamProgress func(acked int64)
+
+const (
+	_STREAM_DATA  = 1
+	_STREAM_END   = 2
+	_STREAM_ACK   = 3
+	_STREAM_DONE  = 4
+	_STREAM_ABORT = 5
+
+	// _STREAM_RETRIES 连续多少次超时没有进展后放弃，每次超时都从接收方确认的位置续传
+	_STREAM_RETRIES = 3
+	// _STREAM_IDLE_TIMEOUT 接收方多久收不到数据后放弃，结束的传输也保留这么久，以便应答重传的结束消息
+	_STREAM_IDLE_TIMEOUT = time.Minute
+)
+
+var errStreamEarlyReturn = errors.New("stream handler returned before the end")
+
+// 所有消息都以 type(1) | uvarint(id) | uvarint(len(from)) | from 开头，from是发出这条消息的节点
+// 数据：| uvarint(len(name)) | name | uvarint(offset) | crc32(4) | data
+// 结束：| uvarint(len(name)) | name | uvarint(total) | crc32(4)
+// 确认：| uvarint(offset)
+// 完成：| uvarint(len(err)) | err
+// 放弃：无
+func encodeStreamHeader(typ byte, id uint64, from string, size int) []byte {
+	var buf = make([]byte, 0, 1+binary.MaxVarintLen64*2+len(from)+size)
+	buf = append(buf, typ)
+	buf = appendUvarint(buf, id)
+	return appendString(buf, from)
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+func readUint32(buf []byte) (uint32, []byte, error) {
+	if len(buf) < 4 {
+		return 0, nil, errMalformedMessage
+	}
+	return binary.BigEndian.Uint32(buf), buf[4:], nil
+}
+
+func encodeStreamData(id uint64, from, name string, offset int64, data []byte) []byte {
+	var buf = encodeStreamHeader(_STREAM_DATA, id, from, 2*binary.MaxVarintLen64+4+len(name)+len(data))
+	buf = appendString(buf, name)
+	buf = appendUvarint(buf, uint64(offset))
+	buf = appendUint32(buf, crc32.ChecksumIEEE(data))
+	return append(buf, data...)
+}
+
+func encodeStreamEnd(id uint64, from, name string, total int64, sum uint32) []byte {
+	var buf = encodeStreamHeader(_STREAM_END, id, from, 2*binary.MaxVarintLen64+4+len(name))
+	buf = appendString(buf, name)
+	buf = appendUvarint(buf, uint64(total))
+	return appendUint32(buf, sum)
+}
+
+func encodeStreamAck(id uint64, from string, offset int64) []byte {
+	return appendUvarint(encodeStreamHeader(_STREAM_ACK, id, from, binary.MaxVarintLen64), uint64(offset))
+}
+
+func encodeStreamDone(id uint64, from, errmsg string) []byte {
+	return appendString(encodeStreamHeader(_STREAM_DONE, id, from, binary.MaxVarintLen64+len(errmsg)), errmsg)
+}
+
+// streamChunk 发送方尚未被确认的块
+type streamChunk struct {
+	offset int64
+	data   []byte
+}
+
+// streamRecv 接收方的一次传输，块可能乱序到达，按顺序交给handler，handler读走后才确认
+type streamRecv struct {
+	st   *streams
+	id   uint64
+	from string
+	pw   *io.PipeWriter
+	// handler返回后关闭
+	hdone chan struct{}
+	herr  error
+
+	mu sync.Mutex
+	// 已经按顺序放入队列的字节数
+	received int64
+	// key<offset> => value<data>，乱序到达的块
+	pending map[int64][]byte
+	// 结束消息到达前为-1
+	total    int64
+	sum      uint32
+	reack    bool
+	queue    chan []byte
+	kick     chan struct{}
+	abort    chan struct{}
+	aborted  bool
+	finished bool
+	result   string
+	expire   time.Time
+}
+
+func (rv *streamRecv) signal() {
+	select {
+	case rv.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (rv *streamRecv) receive(offset int64, data []byte) {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	if rv.finished {
+		return
+	}
+	switch {
+	case offset < rv.received:
+		// 重传的块，对方可能没有收到确认
+		rv.reack = true
+		rv.signal()
+		return
+	case offset > rv.received:
+		if len(rv.pending) < 2*StreamWindow {
+			rv.pending[offset] = data
+		}
+		return
+	}
+	for data != nil {
+		select {
+		case rv.queue <- data:
+		default:
+			// 发送方超出了窗口，丢弃后由它重传
+			return
+		}
+		delete(rv.pending, rv.received)
+		rv.received += int64(len(data))
+		data = rv.pending[rv.received]
+	}
+}
+
+func (rv *streamRecv) end(total int64, sum uint32) {
+	rv.mu.Lock()
+	rv.total, rv.sum = total, sum
+	rv.mu.Unlock()
+	rv.signal()
+}
+
+func (rv *streamRecv) stop() {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	if !rv.aborted {
+		rv.aborted = true
+		close(rv.abort)
+		// handler没有读取时run会阻塞在写入上
+		rv.pw.CloseWithError(ErrStreamAborted)
+	}
+}
+
+// run 把数据写给handler，每写完一块确认一次，全部写完并且校验通过后结束
+func (rv *streamRecv) run() {
+	var consumed int64
+	var sum uint32
+	var err error
+	var idle = time.NewTimer(_STREAM_IDLE_TIMEOUT)
+	defer idle.Stop()
+	for err == nil {
+		select {
+		case data := <-rv.queue:
+			if _, err = rv.pw.Write(data); err != nil {
+				rv.mu.Lock()
+				if err = errStreamEarlyReturn; rv.aborted {
+					err = ErrStreamAborted
+				}
+				rv.mu.Unlock()
+				break
+			}
+			consumed += int64(len(data))
+			sum = crc32.Update(sum, crc32.IEEETable, data)
+			rv.ack(consumed)
+		case <-rv.kick:
+		case <-rv.abort:
+			err = ErrStreamAborted
+		case <-idle.C:
+			err = ErrStreamTimeout
+		}
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(_STREAM_IDLE_TIMEOUT)
+		if err != nil {
+			break
+		}
+
+		rv.mu.Lock()
+		var total, expect, reack = rv.total, rv.sum, rv.reack
+		rv.reack = false
+		rv.mu.Unlock()
+		if total >= 0 && consumed >= total && len(rv.queue) == 0 {
+			if consumed != total || sum != expect {
+				err = ErrStreamChecksum
+			}
+			break
+		}
+		if reack {
+			rv.ack(consumed)
+		}
+	}
+
+	if err == nil {
+		rv.pw.Close()
+	} else {
+		rv.pw.CloseWithError(err)
+	}
+	<-rv.hdone
+
+	var errmsg string
+	switch {
+	case err == ErrStreamChecksum || err == ErrStreamAborted || err == ErrStreamTimeout:
+		errmsg = err.Error()
+	case rv.herr != nil:
+		errmsg = rv.herr.Error()
+	case err != nil:
+		errmsg = err.Error()
+	}
+	rv.finish(errmsg)
+	// 发送方放弃或者超时后已经不再等待，不必通知
+	if err != ErrStreamAborted && err != ErrStreamTimeout {
+		rv.done()
+	}
+}
+
+func (rv *streamRecv) finish(errmsg string) {
+	rv.mu.Lock()
+	rv.finished = true
+	rv.result = errmsg
+	rv.expire = time.Now().Add(_STREAM_IDLE_TIMEOUT)
+	rv.pending = nil
+	rv.mu.Unlock()
+}
+
+func (rv *streamRecv) ack(offset int64) {
+	if err := rv.st.send(rv.from, encodeStreamAck(rv.id, rv.st.srv.localName(), offset)); err != nil {
+		rv.st.srv.ctx.Warn("Unavailable to ack stream", "err", err, "node", rv.from)
+	}
+}
+
+func (rv *streamRecv) done() {
+	rv.mu.Lock()
+	var result = rv.result
+	rv.mu.Unlock()
+	if err := rv.st.send(rv.from, encodeStreamDone(rv.id, rv.st.srv.localName(), result)); err != nil {
+		rv.st.srv.ctx.Warn("Unavailable to finish stream", "err", err, "node", rv.from)
+	}
+}
+
+// streams 在可靠通道上分块传输任意大小的数据
+type streams struct {
+	srv *Server
+	// send 发送流消息，测试时替换
+	send func(name string, msg []byte) error
+
+	mu       sync.RWMutex
+	handlers map[string]StreamHandler
+	// key<id> => value<对方的确认和完成消息>
+	outgoing map[uint64]chan []byte
+	// key<from/id> => value<接收中或者刚结束的传输>
+	incoming map[string]*streamRecv
+}
+
+func newStreams(srv *Server) *streams {
+	var st = &streams{
+		srv:      srv,
+		handlers: make(map[string]StreamHandler),
+		outgoing: make(map[uint64]chan []byte),
+		incoming: make(map[string]*streamRecv),
+	}
+	st.send = func(name string, msg []byte) error {
+		var sender = srv.currentSender()
+		if sender == nil {
+			return ErrNotRunning
+		}
+		return sender.sendRaw(name, encodeMessage(kindStream, msg), true)
+	}
+	return st
+}
+
+func (st *streams) register(name string, h StreamHandler) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.handlers[name]; ok {
+		return fmt.Errorf("stream %s already registered", name)
+	}
+	st.handlers[name] = h
+	return nil
+}
+
+// accept 返回传输，第一次收到时创建，未注册的流直接结束
+func (st *streams) accept(id uint64, from, name string) *streamRecv {
+	var key = fmt.Sprintf("%s/%d", from, id)
+	var now = time.Now()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if rv := st.incoming[key]; rv != nil {
+		return rv
+	}
+	for k, rv := range st.incoming {
+		rv.mu.Lock()
+		if rv.finished && now.After(rv.expire) {
+			delete(st.incoming, k)
+		}
+		rv.mu.Unlock()
+	}
+
+	var pr, pw = io.Pipe()
+	var rv = &streamRecv{
+		st:      st,
+		id:      id,
+		from:    from,
+		pw:      pw,
+		hdone:   make(chan struct{}),
+		pending: make(map[int64][]byte),
+		total:   -1,
+		queue:   make(chan []byte, 2*StreamWindow),
+		kick:    make(chan struct{}, 1),
+		abort:   make(chan struct{}),
+	}
+	st.incoming[key] = rv
+
+	var h = st.handlers[name]
+	if h == nil {
+		rv.finish(ErrUnknownStream.Error())
+		return rv
+	}
+	go func() {
+		defer close(rv.hdone)
+		var ctx, cancel = st.srv.ctx.ForkAt("Stream").WithCancel()
+		defer cancel()
+		rv.herr = h(ctx, from, pr)
+		pr.CloseWithError(errStreamEarlyReturn)
+	}()
+	go rv.run()
+	return rv
+}
+
+func (st *streams) notifyMessage(msg []byte) {
+	if len(msg) == 0 {
+		return
+	}
+	// 数据会被异步交给handler，必须复制
+	msg = append([]byte(nil), msg...)
+	var typ = msg[0]
+	var id, buf, err = readUvarint(msg[1:])
+	if err != nil {
+		return
+	}
+	var from string
+	if from, buf, err = readString(buf); err != nil {
+		return
+	}
+
+	switch typ {
+	case _STREAM_DATA, _STREAM_END:
+		var name string
+		var v uint64
+		var sum uint32
+		if name, buf, err = readString(buf); err != nil {
+			return
+		}
+		if v, buf, err = readUvarint(buf); err != nil {
+			return
+		}
+		if sum, buf, err = readUint32(buf); err != nil {
+			return
+		}
+		if typ == _STREAM_DATA && crc32.ChecksumIEEE(buf) != sum {
+			// 损坏的块不确认，由发送方超时后重传
+			return
+		}
+		var rv = st.accept(id, from, name)
+		rv.mu.Lock()
+		var finished = rv.finished
+		rv.mu.Unlock()
+		switch {
+		case finished:
+			go rv.done()
+		case typ == _STREAM_DATA && len(buf) > 0:
+			rv.receive(int64(v), buf)
+		case typ == _STREAM_END:
+			rv.end(int64(v), sum)
+		}
+	case _STREAM_ABORT:
+		st.mu.RLock()
+		var rv = st.incoming[fmt.Sprintf("%s/%d", from, id)]
+		st.mu.RUnlock()
+		if rv != nil {
+			rv.stop()
+		}
+	case _STREAM_ACK, _STREAM_DONE:
+		st.mu.RLock()
+		var ch = st.outgoing[id]
+		st.mu.RUnlock()
+		if ch != nil {
+			select {
+			case ch <- msg:
+			default:
+				// 确认是累计的，丢弃不影响正确性
+			}
+		}
+	}
+}
+
+// stream 发送方最多缓存一个窗口的块，超时后从接收方确认的位置续传
+func (st *streams) stream(ctx context.Context, node, name string, r io.Reader, progress StreamProgress) (int64, error) {
+	if st.srv.currentSender() == nil {
+		return 0, ErrNotRunning
+	}
+	if st.srv.Peer(node) == nil {
+		return 0, ErrUnknownNode
+	}
+	// 随机ID，重启后不会撞上接收方缓存的已结束传输
+	var id = rand.Uint64()
+	var from = st.srv.localName()
+	var replies = make(chan []byte, 2*StreamWindow)
+	st.mu.Lock()
+	st.outgoing[id] = replies
+	st.mu.Unlock()
+	defer func() {
+		st.mu.Lock()
+		delete(st.outgoing, id)
+		st.mu.Unlock()
+	}()
+
+	var (
+		chunks []streamChunk
+		// chunks[:sent]已经发送
+		sent    int
+		read    int64
+		acked   int64
+		sum     uint32
+		eof     bool
+		ended   bool
+		stalled bool
+		retries int
+		timeout = st.srv.Config.TCPTimeout
+		timer   = time.NewTimer(timeout)
+	)
+	defer timer.Stop()
+	var fail = func(err error) (int64, error) {
+		st.send(node, encodeStreamHeader(_STREAM_ABORT, id, from, 0))
+		return acked, err
+	}
+	for {
+		for !eof && len(chunks) < StreamWindow {
+			var data = make([]byte, StreamChunkSize)
+			var n, err = io.ReadFull(r, data)
+			switch err {
+			case nil:
+			case io.EOF, io.ErrUnexpectedEOF:
+				eof = true
+			default:
+				return fail(err)
+			}
+			if n > 0 {
+				chunks = append(chunks, streamChunk{offset: read, data: data[:n]})
+				sum = crc32.Update(sum, crc32.IEEETable, data[:n])
+				read += int64(n)
+			}
+		}
+
+		var err error
+		for ; !stalled && sent < len(chunks); sent++ {
+			var c = chunks[sent]
+			if err = st.send(node, encodeStreamData(id, from, name, c.offset, c.data)); err != nil {
+				break
+			}
+		}
+		if err == nil && !stalled && eof && !ended {
+			if err = st.send(node, encodeStreamEnd(id, from, name, read, sum)); err == nil {
+				ended = true
+			}
+		}
+		if err != nil {
+			// 等到超时后再续传
+			stalled = true
+			st.srv.ctx.Warn("Unavailable to send stream", "err", err, "node", node, "stream", name)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fail(ctx.Err())
+		case <-timer.C:
+			if retries++; retries > _STREAM_RETRIES {
+				return fail(ErrStreamTimeout)
+			}
+			sent, ended, stalled = 0, false, false
+			timer.Reset(timeout)
+		case msg := <-replies:
+			var typ = msg[0]
+			var _, buf, _ = readUvarint(msg[1:])
+			var peer string
+			if peer, buf, err = readString(buf); err != nil || peer != node {
+				continue
+			}
+			if typ == _STREAM_DONE {
+				var errmsg, _, err = readString(buf)
+				switch {
+				case err != nil:
+					continue
+				case errmsg == "":
+					if acked < read && progress != nil {
+						progress(read)
+					}
+					return read, nil
+				case errmsg == ErrUnknownStream.Error():
+					return acked, ErrUnknownStream
+				case errmsg == ErrStreamChecksum.Error():
+					return acked, ErrStreamChecksum
+				default:
+					return acked, &RemoteError{Node: node, Method: name, Message: errmsg}
+				}
+			}
+			var v uint64
+			if v, _, err = readUvarint(buf); err != nil || int64(v) <= acked || int64(v) > read {
+				continue
+			}
+			acked = int64(v)
+			var n = 0
+			for n < len(chunks) && chunks[n].offset+int64(len(chunks[n].data)) <= acked {
+				n++
+			}
+			chunks = chunks[n:]
+			if sent -= n; sent < 0 {
+				sent = 0
+			}
+			retries = 0
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(timeout)
+			if progress != nil {
+				progress(acked)
+			}
+		}
+	}
+}
+
+// HandleStream register the handler of the named stream, it could be called before or after serving
+func (s *Server) HandleStream(name string, h StreamHandler) error {
+	return s.streams.register(name, h)
+}
+
+// SendStream send the payload read from r to the given node in chunks, and return the number of bytes
+// consumed by the receiver. Every chunk carries a checksum, at most StreamWindow chunks are not consumed,
+// and the stream resumes from the last consumed byte if no progress made in Config.TCPTimeout.
+// progress is called with the number of bytes consumed, it could be nil.
+func (s *Server) SendStream(ctx context.Context, node, name string, r io.Reader, progress StreamProgress) (int64, error) {
+	return s.streams.stream(ctx, node, name, r, progress)
+}
@@ -0,0 +1,130 @@
+package gossip
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+
+	"github.com/cjey/gbase/context"
+)
+
+// streamPair 两个节点直接相连，link可以丢弃或者篡改消息
+func streamPair(link func(msg []byte) []byte) (*Server, *Server) {
+	var a, b = NewServer("a", ""), NewServer("b", "")
+	for _, s := range []*Server{a, b} {
+		s.ctx = context.Simple()
+		s.sender = newSender(s, nil)
+		s.Config.TCPTimeout = 50 * time.Millisecond
+	}
+	a.name, b.name = "a", "b"
+	a.peers["b"] = newNode(&memberlist.Node{Name: "b"})
+	b.peers["a"] = newNode(&memberlist.Node{Name: "a"})
+	var connect = func(from, to *Server) {
+		from.streams.send = func(name string, msg []byte) error {
+			if msg = link(append([]byte(nil), msg...)); msg != nil {
+				// 每条可靠消息都是独立的连接，到达顺序不确定
+				go to.streams.notifyMessage(msg)
+			}
+			return nil
+		}
+	}
+	connect(a, b)
+	connect(b, a)
+	return a, b
+}
+
+func TestStreamResume(t *testing.T) {
+	defer func(size, window int) {
+		StreamChunkSize, StreamWindow = size, window
+	}(StreamChunkSize, StreamWindow)
+	StreamChunkSize, StreamWindow = 1024, 4
+
+	var mu sync.Mutex
+	var n int
+	var a, b = streamPair(func(msg []byte) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		n++
+		switch {
+		case msg[0] == _STREAM_DATA && n%7 == 0:
+			return nil
+		case msg[0] == _STREAM_DATA && n%11 == 0:
+			msg[len(msg)-1] ^= 0xff
+		case msg[0] == _STREAM_ACK && n%5 == 0:
+			return nil
+		}
+		return msg
+	})
+
+	var payload = make([]byte, 100*1024+17)
+	rand.Read(payload)
+	var got = make(chan []byte, 1)
+	b.HandleStream("bundle", func(ctx context.Context, from string, r io.Reader) error {
+		var buf, err = ioutil.ReadAll(r)
+		if err != nil || from != "a" {
+			t.Errorf("unexpected stream from %s, %v", from, err)
+		}
+		got <- buf
+		return nil
+	})
+
+	var last int64
+	var sent, err = a.SendStream(context.Simple(), "b", "bundle", bytes.NewReader(payload), func(acked int64) {
+		if acked <= last {
+			t.Errorf("progress should increase, %d after %d", acked, last)
+		}
+		last = acked
+	})
+	if err != nil || sent != int64(len(payload)) || last != sent {
+		t.Fatalf("unexpected result %d, %d, %v", sent, last, err)
+	}
+	if buf := <-got; !bytes.Equal(buf, payload) {
+		t.Errorf("payload mismatch, %d bytes received", len(buf))
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	var a, b = streamPair(func(msg []byte) []byte { return msg })
+	b.HandleStream("broken", func(ctx context.Context, from string, r io.Reader) error {
+		return errors.New("disk full")
+	})
+	b.HandleStream("empty", func(ctx context.Context, from string, r io.Reader) error {
+		var buf, err = ioutil.ReadAll(r)
+		if err != nil || len(buf) != 0 {
+			t.Errorf("unexpected payload %q, %v", buf, err)
+		}
+		return nil
+	})
+	if err := b.HandleStream("empty", nil); err == nil {
+		t.Errorf("duplicated stream should be rejected")
+	}
+
+	var ctx = context.Simple()
+	var payload = bytes.Repeat([]byte("x"), 3*StreamChunkSize)
+	if _, err := a.SendStream(ctx, "b", "missing", bytes.NewReader(payload), nil); err != ErrUnknownStream {
+		t.Errorf("expect ErrUnknownStream, got %v", err)
+	}
+	var re *RemoteError
+	if _, err := a.SendStream(ctx, "b", "broken", bytes.NewReader(payload), nil); !errors.As(err, &re) || re.Message != "disk full" {
+		t.Errorf("expect remote error, got %v", err)
+	}
+	if n, err := a.SendStream(ctx, "b", "empty", bytes.NewReader(nil), nil); n != 0 || err != nil {
+		t.Errorf("unexpected result of empty stream %d, %v", n, err)
+	}
+	if _, err := a.SendStream(ctx, "c", "empty", bytes.NewReader(nil), nil); err != ErrUnknownNode {
+		t.Errorf("expect ErrUnknownNode, got %v", err)
+	}
+
+	// receiver never answers
+	a.streams.send = func(name string, msg []byte) error { return nil }
+	if _, err := a.SendStream(ctx, "b", "empty", bytes.NewReader(payload), nil); err != ErrStreamTimeout {
+		t.Errorf("expect ErrStreamTimeout, got %v", err)
+	}
+}
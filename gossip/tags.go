@@ -0,0 +1,209 @@
+package gossip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// metaMagic 元数据的前缀，单个版本字节可能和旧节点的原始元数据冲突，用多字节的前缀区分，
+// 没有这个前缀的元数据整体视为用户的原始数据
+const metaMagic = "\xc7gb"
+
+// metaVersion 节点元数据的格式版本
+// 元数据格式：magic(3) | version(3) | str(cluster) | uvarint(protocol) | uvarint(started) | tags | 用户通过Delegate.Metadata提供的原始数据
+// version(1)的格式中没有cluster和protocol，version(2)的格式中没有started，视为空
+const (
+	metaVersionV1 = 1
+	metaVersionV2 = 2
+	metaVersion   = 3
+)
+
+// ErrInvalidTags means the tags can not be encoded
+var ErrInvalidTags = errors.New("invalid tags")
+
+// Tags is the structured metadata of node, e.g. role, zone, version
+type Tags map[string]string
+
+// Clone return a copy of tags
+func (t Tags) Clone() Tags {
+	if t == nil {
+		return nil
+	}
+	var c = make(Tags, len(t))
+	for k, v := range t {
+		c[k] = v
+	}
+	return c
+}
+
+// Size return the encoded size of tags
+func (t Tags) Size() int {
+	return len(encodeTags(t))
+}
+
+// Validate check the tags could be advertised in the metadata,
+// the encoded tags must not exceed memberlist.MetaMaxSize
+func (t Tags) Validate() error {
+	for k := range t {
+		if k == "" {
+			return fmt.Errorf("%w, empty tag key", ErrInvalidTags)
+		}
+	}
+	var limit = memberlist.MetaMaxSize - len(metaMagic) - 1 // 预留前缀和版本号
+	if size := t.Size(); size > limit {
+		return fmt.Errorf("%w, encoded size %d exceeds limit %d", ErrInvalidTags, size, limit)
+	}
+	return nil
+}
+
+// 编码格式：uvarint(count) | (uvarint(len(key)) | key | uvarint(len(value)) | value)*，key有序
+func encodeTags(t Tags) []byte {
+	var keys = make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf = make([]byte, 0, binary.MaxVarintLen64)
+	buf = appendUvarint(buf, uint64(len(keys)))
+	for _, k := range keys {
+		buf = appendString(buf, k)
+		buf = appendString(buf, t[k])
+	}
+	return buf
+}
+
+func decodeTags(buf []byte) (Tags, []byte, error) {
+	var n, rest, err = readUvarint(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if n > uint64(len(rest)) {
+		return nil, nil, errMalformedMessage
+	}
+	var t = make(Tags, n)
+	for i := uint64(0); i < n; i++ {
+		var k, v string
+		if k, rest, err = readString(rest); err != nil {
+			return nil, nil, err
+		}
+		if v, rest, err = readString(rest); err != nil {
+			return nil, nil, err
+		}
+		t[k] = v
+	}
+	return t, rest, nil
+}
+
+type nodeMeta struct {
+	cluster  string
+	protocol uint32
+	// 本次运行的启动时间(unix nano)，名字冲突时用于判断哪个节点更新
+	started int64
+	tags    Tags
+	meta    []byte
+}
+
+func encodeMeta(m nodeMeta) []byte {
+	var t = encodeTags(m.tags)
+	var buf = make([]byte, 0, len(metaMagic)+1+binary.MaxVarintLen64*3+len(m.cluster)+len(t)+len(m.meta))
+	buf = append(buf, metaMagic...)
+	buf = append(buf, metaVersion)
+	buf = appendString(buf, m.cluster)
+	buf = appendUvarint(buf, uint64(m.protocol))
+	buf = appendUvarint(buf, uint64(m.started))
+	buf = append(buf, t...)
+	return append(buf, m.meta...)
+}
+
+// decodeMeta 解析元数据，无法解析时整体视为用户的原始数据
+func decodeMeta(buf []byte) nodeMeta {
+	var m = nodeMeta{meta: buf}
+	if len(buf) <= len(metaMagic) || string(buf[:len(metaMagic)]) != metaMagic {
+		return m
+	}
+	var rest = buf[len(metaMagic)+1:]
+	var err error
+	switch buf[len(metaMagic)] {
+	case metaVersionV1:
+	case metaVersionV2, metaVersion:
+		var protocol, started uint64
+		var cluster string
+		if cluster, rest, err = readString(rest); err != nil {
+			return m
+		}
+		if protocol, rest, err = readUvarint(rest); err != nil || protocol > math.MaxUint32 {
+			return m
+		}
+		if buf[len(metaMagic)] == metaVersion {
+			if started, rest, err = readUvarint(rest); err != nil || started > math.MaxInt64 {
+				return m
+			}
+		}
+		m.cluster, m.protocol, m.started = cluster, uint32(protocol), int64(started)
+	default:
+		return m
+	}
+	var tags Tags
+	if tags, rest, err = decodeTags(rest); err != nil {
+		return nodeMeta{meta: buf}
+	}
+	m.tags, m.meta = tags, rest
+	return m
+}
+
+// SetTags replace the tags of local node, it could be called before serving.
+// After serving, use Sender.SetTags instead to notify the cluster.
+func (s *Server) SetTags(tags Tags) error {
+	if err := tags.Validate(); err != nil {
+		return err
+	}
+	var m = nodeMeta{cluster: s.Segment.Cluster, protocol: s.Segment.Protocol, tags: tags}
+	if size := len(encodeMeta(m)); size > memberlist.MetaMaxSize {
+		return fmt.Errorf("%w, metadata size %d exceeds limit %d", ErrInvalidTags, size, memberlist.MetaMaxSize)
+	}
+	s.tmu.Lock()
+	s.tags = tags.Clone()
+	s.tmu.Unlock()
+	return nil
+}
+
+// Tags return a copy of the tags of local node
+func (s *Server) Tags() Tags {
+	s.tmu.RLock()
+	defer s.tmu.RUnlock()
+	return s.tags.Clone()
+}
+
+// localMeta 本节点的元数据，不含用户数据
+func (s *Server) localMeta() nodeMeta {
+	return nodeMeta{
+		cluster:  s.Segment.Cluster,
+		protocol: s.Segment.Protocol,
+		started:  atomic.LoadInt64(&s.started),
+		tags:     s.Tags(),
+	}
+}
+
+// SetTags replace the tags of local node, and update the metadata to the cluster
+func (s *Sender) SetTags(tags Tags, timeout time.Duration) error {
+	if s == nil {
+		return nil
+	}
+	if err := s.srv.SetTags(tags); err != nil {
+		return err
+	}
+	return s.UpdateMetadata(timeout)
+}
+
+// Tags return the tags advertised by the node, it should not be modified
+func (n *Node) Tags() Tags {
+	return n.tags
+}
@@ -0,0 +1,61 @@
+package gossip
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func TestTagsMeta(t *testing.T) {
+	var tags = Tags{"role": "api", "zone": "bj-1", "version": "1.2.0"}
+	var buf = encodeMeta(nodeMeta{started: 42, tags: tags, meta: []byte("raw")})
+
+	var node = newNode(&memberlist.Node{Name: "a", Meta: buf})
+	if len(node.Tags()) != 3 || node.Tags()["zone"] != "bj-1" {
+		t.Errorf("unexpected tags %v", node.Tags())
+	}
+	if string(node.Meta) != "raw" || node.started != 42 {
+		t.Errorf("unexpected meta %q, started %d", node.Meta, node.started)
+	}
+
+	// version 2 has no start time
+	var v2 = append([]byte(metaMagic+"\x02"), appendString(nil, "prod")...)
+	v2 = appendUvarint(v2, 3)
+	v2 = append(v2, encodeTags(tags)...)
+	node = newNode(&memberlist.Node{Name: "v2", Meta: append(v2, "raw"...)})
+	if node.cluster != "prod" || node.protocol != 3 || node.started != 0 || len(node.Tags()) != 3 || string(node.Meta) != "raw" {
+		t.Errorf("unexpected version 2 meta %+v", node)
+	}
+
+	// legacy meta without tags
+	node = newNode(&memberlist.Node{Name: "b", Meta: []byte("legacy")})
+	if node.Tags() != nil || string(node.Meta) != "legacy" {
+		t.Errorf("legacy meta should be kept, got %q %v", node.Meta, node.Tags())
+	}
+	// legacy meta looks like a version byte
+	for _, raw := range []string{"\x01\x00", "\x02\x00\x00\x00"} {
+		node = newNode(&memberlist.Node{Name: "c", Meta: []byte(raw)})
+		if node.Tags() != nil || string(node.Meta) != raw {
+			t.Errorf("legacy meta %q should be kept, got %q %v", raw, node.Meta, node.Tags())
+		}
+	}
+}
+
+func TestTagsValidate(t *testing.T) {
+	if err := (Tags{"": "x"}).Validate(); !errors.Is(err, ErrInvalidTags) {
+		t.Errorf("empty key should be invalid, got %v", err)
+	}
+	var big = Tags{"k": strings.Repeat("x", memberlist.MetaMaxSize)}
+	if err := big.Validate(); !errors.Is(err, ErrInvalidTags) {
+		t.Errorf("large tags should be invalid, got %v", err)
+	}
+	var srv = NewServer("a", "")
+	if err := srv.SetTags(big); err == nil {
+		t.Error("server should refuse large tags")
+	}
+	if err := srv.SetTags(Tags{"role": "api"}); err != nil || srv.Tags()["role"] != "api" {
+		t.Errorf("set tags failed, %v", err)
+	}
+}
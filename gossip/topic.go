@@ -0,0 +1,165 @@
+package gossip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// topicEnvelopeVersion 信封格式版本，格式变化时递增
+const topicEnvelopeVersion = 1
+
+// ErrTopicTooLarge means the encoded topic message could not fit in one gossip packet
+var ErrTopicTooLarge = errors.New("topic message too large")
+
+// TopicMessage is a message published to a topic
+type TopicMessage struct {
+	// Version of the envelope
+	Version uint8
+	// Topic name
+	Topic string
+	// From is the origin node name
+	From string
+	// ID is unique in origin node
+	ID uint64
+	// Payload should be copied if you want to keep it
+	Payload []byte
+}
+
+// TopicHandler handle the message of subscribed topic
+type TopicHandler func(*TopicMessage)
+
+// 信封格式：
+// version(1) | uvarint(len(topic)) | topic | uvarint(len(from)) | from | uvarint(id) | payload
+func encodeTopicMessage(m *TopicMessage) []byte {
+	var buf = make([]byte, 0, 1+3*binary.MaxVarintLen64+len(m.Topic)+len(m.From)+len(m.Payload))
+	buf = append(buf, m.Version)
+	buf = appendString(buf, m.Topic)
+	buf = appendString(buf, m.From)
+	buf = appendUvarint(buf, m.ID)
+	return append(buf, m.Payload...)
+}
+
+func decodeTopicMessage(buf []byte) (*TopicMessage, error) {
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("empty topic message")
+	}
+	var m = &TopicMessage{Version: buf[0]}
+	if m.Version != topicEnvelopeVersion {
+		return nil, fmt.Errorf("unsupported topic envelope version %d", m.Version)
+	}
+	buf = buf[1:]
+
+	var err error
+	if m.Topic, buf, err = readString(buf); err != nil {
+		return nil, err
+	}
+	if m.From, buf, err = readString(buf); err != nil {
+		return nil, err
+	}
+	if m.ID, buf, err = readUvarint(buf); err != nil {
+		return nil, err
+	}
+	m.Payload = buf
+	return m, nil
+}
+
+type topicSubscriber struct {
+	topic   string
+	handler TopicHandler
+}
+
+type topicMux struct {
+	seq  uint64
+	subs subscribers
+}
+
+func newTopicMux() *topicMux {
+	return &topicMux{}
+}
+
+func (t *topicMux) nextID() uint64 {
+	return atomic.AddUint64(&t.seq, 1)
+}
+
+func (t *topicMux) subscribe(topic string, h TopicHandler) func() {
+	var sub = &topicSubscriber{topic: topic, handler: h}
+	t.subs.add(sub)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.subs.remove(sub)
+		})
+	}
+}
+
+func (t *topicMux) dispatch(msg []byte) {
+	var m, err = decodeTopicMessage(msg)
+	if err != nil {
+		return
+	}
+	for _, s := range t.subs.snapshot() {
+		if s := s.(*topicSubscriber); s.topic == m.Topic {
+			s.handler(m)
+		}
+	}
+}
+
+// Subscribe register a handler for the topic, it could be called before or after serving.
+// The returned function is used to unsubscribe.
+func (s *Server) Subscribe(topic string, h TopicHandler) (unsubscribe func()) {
+	return s.topics.subscribe(topic, h)
+}
+
+func (s *Sender) newTopicMessage(topic string, payload []byte) []byte {
+	var m = &TopicMessage{
+		Version: topicEnvelopeVersion,
+		Topic:   topic,
+		From:    s.srv.localName(),
+		ID:      s.srv.topics.nextID(),
+		Payload: payload,
+	}
+	return encodeMessage(kindTopic, encodeTopicMessage(m))
+}
+
+// Subscribe is same as Server.Subscribe
+func (s *Sender) Subscribe(topic string, h TopicHandler) (unsubscribe func()) {
+	if s == nil {
+		return func() {}
+	}
+	return s.srv.Subscribe(topic, h)
+}
+
+// Publish broadcast the payload to the subscribers of the topic on all other nodes,
+// the message is piggybacked on gossip packets, ErrTopicTooLarge is returned if it could not fit in one
+// (Config.UDPBufferSize), use PublishReliable for the large payload
+func (s *Sender) Publish(topic string, payload []byte) error {
+	if s == nil {
+		return nil
+	}
+	var msg = s.newTopicMessage(topic, payload)
+	if !s.fitsPacket(msg) {
+		return fmt.Errorf("%w, %d bytes exceed %d", ErrTopicTooLarge, len(msg), s.srv.Config.UDPBufferSize-_PACKET_OVERHEAD)
+	}
+	s.queueBroadcast(PriorityNormal, broadcast(msg))
+	return nil
+}
+
+// PublishReliable send the payload to the subscribers of the topic on the given node by tcp
+func (s *Sender) PublishReliable(name, topic string, payload []byte) {
+	if s == nil {
+		return
+	}
+	s.sendRaw(name, s.newTopicMessage(topic, payload), true)
+}
+
+// PublishBestEffort send the payload to the subscribers of the topic on the given node by udp
+func (s *Sender) PublishBestEffort(name, topic string, payload []byte) {
+	if s == nil {
+		return
+	}
+	s.sendRaw(name, s.newTopicMessage(topic, payload), false)
+}
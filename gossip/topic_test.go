@@ -0,0 +1,63 @@
+package gossip
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestTopicEnvelope(t *testing.T) {
+	var m = &TopicMessage{
+		Version: topicEnvelopeVersion,
+		Topic:   "status",
+		From:    "node-1",
+		ID:      300,
+		Payload: []byte("busy"),
+	}
+	var got, err = decodeTopicMessage(encodeTopicMessage(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Topic != m.Topic || got.From != m.From || got.ID != m.ID || !bytes.Equal(got.Payload, m.Payload) {
+		t.Errorf("envelope mismatch, got %+v", got)
+	}
+
+	if _, err := decodeTopicMessage([]byte{topicEnvelopeVersion, 10, 'a'}); err == nil {
+		t.Error("malformed envelope should fail")
+	}
+	if _, err := decodeTopicMessage([]byte{topicEnvelopeVersion + 1}); err == nil {
+		t.Error("unknown version should fail")
+	}
+}
+
+func TestTopicDispatch(t *testing.T) {
+	var mux = newTopicMux()
+	var got []string
+	var unsub = mux.subscribe("a", func(m *TopicMessage) {
+		got = append(got, string(m.Payload))
+	})
+	mux.subscribe("b", func(m *TopicMessage) {
+		t.Error("topic b should not receive message")
+	})
+
+	var msg = &TopicMessage{Version: topicEnvelopeVersion, Topic: "a", Payload: []byte("x")}
+	mux.dispatch(encodeTopicMessage(msg))
+	unsub()
+	mux.dispatch(encodeTopicMessage(msg))
+	if len(got) != 1 || got[0] != "x" {
+		t.Errorf("unexpected dispatch result %v", got)
+	}
+}
+
+func TestTopicPublishTooLarge(t *testing.T) {
+	var s = newSender(NewServer("a", ""), nil)
+	if err := s.Publish("a", make([]byte, s.srv.Config.UDPBufferSize)); !errors.Is(err, ErrTopicTooLarge) {
+		t.Errorf("large payload should be refused, got %v", err)
+	}
+	if err := s.Publish("a", []byte("x")); err != nil {
+		t.Errorf("small payload should be published, got %v", err)
+	}
+	if stats := s.LaneStats(); stats[PriorityNormal].Queued != 1 {
+		t.Errorf("only the small one should be queued, got %+v", stats[PriorityNormal])
+	}
+}
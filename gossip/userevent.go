@@ -0,0 +1,307 @@
+package gossip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cjey/gbase/context"
+)
+
+// UserEventSizeLimit is the max size of name and payload of a user event,
+// events are piggybacked on gossip packets, so it must be small
+var UserEventSizeLimit = 512
+
+// ErrEventTooLarge means the name and payload of user event exceed UserEventSizeLimit
+var ErrEventTooLarge = errors.New("user event too large")
+
+// userEventVersion 信封格式版本，格式变化时递增
+const userEventVersion = 1
+
+const (
+	// _USER_EVENT_BUFFER 去重窗口，以lamport时间计，更早的事件直接丢弃
+	_USER_EVENT_BUFFER = 512
+	// _USER_EVENT_QUEUE 每个订阅者待处理事件的队列长度，队列满时丢弃新事件
+	_USER_EVENT_QUEUE = 1024
+)
+
+// UserEvent is a named event fired to the whole cluster
+type UserEvent struct {
+	Name string
+	// From is the origin node name
+	From string
+	// LTime is the lamport time of the event, events fired later always have larger LTime
+	// than the ones the origin node had seen
+	LTime uint64
+	// Payload should be copied if you want to keep it
+	Payload []byte
+}
+
+// UserEventHandler handle the user event, events of a subscription are delivered one by one
+type UserEventHandler func(ctx context.Context, ev *UserEvent)
+
+// 信封格式：
+// version(1) | uvarint(ltime) | uvarint(len(from)) | from | uvarint(len(name)) | name | payload
+func encodeUserEvent(ev *UserEvent) []byte {
+	var buf = make([]byte, 0, 1+binary.MaxVarintLen64*3+len(ev.From)+len(ev.Name)+len(ev.Payload))
+	buf = append(buf, userEventVersion)
+	buf = appendUvarint(buf, ev.LTime)
+	buf = appendString(buf, ev.From)
+	buf = appendString(buf, ev.Name)
+	return append(buf, ev.Payload...)
+}
+
+func decodeUserEvent(buf []byte) (*UserEvent, error) {
+	if len(buf) == 0 || buf[0] != userEventVersion {
+		return nil, errMalformedMessage
+	}
+	buf = buf[1:]
+
+	var ev = &UserEvent{}
+	var err error
+	if ev.LTime, buf, err = readUvarint(buf); err != nil {
+		return nil, err
+	}
+	if ev.From, buf, err = readString(buf); err != nil {
+		return nil, err
+	}
+	if ev.Name, buf, err = readString(buf); err != nil {
+		return nil, err
+	}
+	ev.Payload = buf
+	return ev, nil
+}
+
+// lamportClock 逻辑时钟，本地事件递增，收到其他节点的事件时追上对方
+type lamportClock struct {
+	counter uint64
+}
+
+func (c *lamportClock) time() uint64 {
+	return atomic.LoadUint64(&c.counter)
+}
+
+func (c *lamportClock) increment() uint64 {
+	return atomic.AddUint64(&c.counter, 1)
+}
+
+func (c *lamportClock) witness(t uint64) {
+	for {
+		var cur = atomic.LoadUint64(&c.counter)
+		if t < cur || atomic.CompareAndSwapUint64(&c.counter, cur, t+1) {
+			return
+		}
+	}
+}
+
+// eventSlot 去重窗口中某个lamport时间上已经见过的事件
+type eventSlot struct {
+	ltime uint64
+	seen  map[string]bool
+}
+
+type eventSubscription struct {
+	name     string
+	coalesce time.Duration
+	handler  UserEventHandler
+	queue    chan *UserEvent
+	done     chan struct{}
+}
+
+// run 逐个投递事件，合并模式下同名事件在窗口内只保留lamport时间最大的一个
+func (sub *eventSubscription) run(u *userEvents) {
+	var pending = make(map[string]*UserEvent)
+	// 合并模式下，已经投递过的每个名字的最大lamport时间，更旧的事件被丢弃，
+	// 每次投递后清理早于去重窗口的名字，所以最多只有去重窗口内出现过的那些名字
+	var delivered = make(map[string]uint64)
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-sub.done:
+			return
+		case ev := <-sub.queue:
+			if sub.coalesce <= 0 {
+				u.deliver(sub, ev)
+				continue
+			}
+			if ev.LTime <= delivered[ev.Name] {
+				continue
+			}
+			if old := pending[ev.Name]; old == nil || ev.LTime > old.LTime {
+				pending[ev.Name] = ev
+			}
+			if timer == nil {
+				timer = time.After(sub.coalesce)
+			}
+		case <-timer:
+			timer = nil
+			var evs = make([]*UserEvent, 0, len(pending))
+			for name, ev := range pending {
+				evs = append(evs, ev)
+				delivered[name] = ev.LTime
+				delete(pending, name)
+			}
+			sort.Slice(evs, func(i, j int) bool {
+				return evs[i].LTime < evs[j].LTime
+			})
+			for _, ev := range evs {
+				u.deliver(sub, ev)
+			}
+			// 早于去重窗口的事件在remember时已被丢弃，不再需要记录这些名字
+			if now := u.clock.time(); now > _USER_EVENT_BUFFER {
+				for name, ltime := range delivered {
+					if ltime < now-_USER_EVENT_BUFFER {
+						delete(delivered, name)
+					}
+				}
+			}
+		}
+	}
+}
+
+type userEvents struct {
+	srv   *Server
+	clock lamportClock
+
+	mu     sync.Mutex
+	buffer []*eventSlot
+
+	subs subscribers
+}
+
+func newUserEvents(srv *Server) *userEvents {
+	return &userEvents{
+		srv:    srv,
+		buffer: make([]*eventSlot, _USER_EVENT_BUFFER),
+	}
+}
+
+// remember 记录事件，如果已经见过或者早于去重窗口则返回false
+func (u *userEvents) remember(ev *UserEvent) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var now = u.clock.time()
+	if now > _USER_EVENT_BUFFER && ev.LTime < now-_USER_EVENT_BUFFER {
+		return false
+	}
+	var idx = ev.LTime % _USER_EVENT_BUFFER
+	var slot = u.buffer[idx]
+	if slot == nil || slot.ltime != ev.LTime {
+		slot = &eventSlot{ltime: ev.LTime, seen: make(map[string]bool)}
+		u.buffer[idx] = slot
+	}
+	// 同一节点的lamport时间不会重复，所以来源节点和时间唯一确定一个事件
+	if slot.seen[ev.From] {
+		return false
+	}
+	slot.seen[ev.From] = true
+	return true
+}
+
+func (u *userEvents) subscribe(name string, coalesce time.Duration, h UserEventHandler) func() {
+	var sub = &eventSubscription{
+		name:     name,
+		coalesce: coalesce,
+		handler:  h,
+		queue:    make(chan *UserEvent, _USER_EVENT_QUEUE),
+		done:     make(chan struct{}),
+	}
+	u.subs.add(sub)
+	go sub.run(u)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			u.subs.remove(sub)
+			close(sub.done)
+		})
+	}
+}
+
+// dispatch 不能阻塞memberlist的消息处理协程，订阅者处理不过来时丢弃
+func (u *userEvents) dispatch(ev *UserEvent) {
+	for _, s := range u.subs.snapshot() {
+		var sub = s.(*eventSubscription)
+		if sub.name != "" && sub.name != ev.Name {
+			continue
+		}
+		select {
+		case sub.queue <- ev:
+		default:
+			u.srv.ctx.Warn("User event dropped, handler is too slow", "event", ev.Name, "from", ev.From)
+		}
+	}
+}
+
+// deliver handler的panic只记录日志，后续的事件照常投递
+func (u *userEvents) deliver(sub *eventSubscription, ev *UserEvent) {
+	var ctx = u.srv.ctx.ForkAt("UserEvent")
+	safeCall(ctx, "User event", func() error {
+		sub.handler(ctx, ev)
+		return nil
+	}, "event", ev.Name, "from", ev.From)
+}
+
+// notifyMessage 首次收到的事件会再次广播，保证在较大的集群中也能送达所有节点
+func (u *userEvents) notifyMessage(msg []byte) {
+	// 事件会被异步投递和转发，必须复制
+	msg = append([]byte(nil), msg...)
+	var ev, err = decodeUserEvent(msg)
+	if err != nil {
+		return
+	}
+	u.clock.witness(ev.LTime)
+	if !u.remember(ev) {
+		return
+	}
+	if sender := u.srv.currentSender(); sender != nil {
+		sender.queueBroadcast(PriorityNormal, broadcast(encodeMessage(kindEvent, msg)))
+	}
+	u.dispatch(ev)
+}
+
+func (u *userEvents) fire(name string, payload []byte) error {
+	if len(name)+len(payload) > UserEventSizeLimit {
+		return fmt.Errorf("%w, %d bytes exceed %d", ErrEventTooLarge, len(name)+len(payload), UserEventSizeLimit)
+	}
+	var sender = u.srv.currentSender()
+	if sender == nil {
+		return ErrNotRunning
+	}
+	var data = make([]byte, len(payload))
+	copy(data, payload)
+	var ev = &UserEvent{
+		Name:    name,
+		From:    u.srv.localName(),
+		LTime:   u.clock.increment(),
+		Payload: data,
+	}
+	u.remember(ev)
+	sender.queueBroadcast(PriorityNormal, broadcast(encodeMessage(kindEvent, encodeUserEvent(ev))))
+	u.dispatch(ev)
+	return nil
+}
+
+// FireEvent broadcast the user event to all nodes, include the local node.
+// Duplicated deliveries are filtered, and every node advances its lamport clock by the events it received.
+func (s *Server) FireEvent(name string, payload []byte) error {
+	return s.uevents.fire(name, payload)
+}
+
+// HandleEvent register the handler of user events with the name, all events if name is empty,
+// it could be called before or after serving. The returned function is used to cancel.
+// If coalesce > 0, events with the same name in the window are coalesced,
+// only the one with the largest LTime is delivered at the end of window,
+// and events older than the delivered one are dropped.
+func (s *Server) HandleEvent(name string, coalesce time.Duration, h UserEventHandler) (cancel func()) {
+	return s.uevents.subscribe(name, coalesce, h)
+}
+
+// EventTime return the current lamport time of user events
+func (s *Server) EventTime() uint64 {
+	return s.uevents.clock.time()
+}
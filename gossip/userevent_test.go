@@ -0,0 +1,105 @@
+package gossip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cjey/gbase/context"
+)
+
+func TestUserEventEnvelope(t *testing.T) {
+	var ev = &UserEvent{Name: "deploy", From: "a", LTime: 42, Payload: []byte("v1")}
+	var got, err = decodeUserEvent(encodeUserEvent(ev))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != ev.Name || got.From != ev.From || got.LTime != ev.LTime || string(got.Payload) != "v1" {
+		t.Errorf("unexpected event %+v", got)
+	}
+	if _, err = decodeUserEvent([]byte{9}); err == nil {
+		t.Error("unknown version should be rejected")
+	}
+
+	var c lamportClock
+	c.increment()
+	c.witness(10)
+	c.witness(3)
+	if c.time() != 11 {
+		t.Errorf("unexpected lamport time %d", c.time())
+	}
+}
+
+func TestUserEventDedupAndCoalesce(t *testing.T) {
+	var s = NewServer("a", "")
+	s.name = "a"
+	s.ctx = context.Simple()
+
+	var all = make(chan *UserEvent, 16)
+	var coalesced = make(chan *UserEvent, 16)
+	defer s.HandleEvent("", 0, func(ctx context.Context, ev *UserEvent) { all <- ev })()
+	defer s.HandleEvent("deploy", 50*time.Millisecond, func(ctx context.Context, ev *UserEvent) { coalesced <- ev })()
+
+	for _, ev := range []*UserEvent{
+		{Name: "deploy", From: "b", LTime: 1, Payload: []byte("v1")},
+		{Name: "deploy", From: "b", LTime: 1, Payload: []byte("v1")}, // duplicated
+		{Name: "deploy", From: "c", LTime: 3, Payload: []byte("v3")},
+		{Name: "deploy", From: "b", LTime: 2, Payload: []byte("v2")},
+		{Name: "restart", From: "c", LTime: 4},
+	} {
+		s.uevents.notifyMessage(encodeUserEvent(ev))
+	}
+	if s.EventTime() != 5 {
+		t.Errorf("clock should witness the remote events, got %d", s.EventTime())
+	}
+
+	var names []string
+	for i := 0; i < 4; i++ {
+		select {
+		case ev := <-all:
+			names = append(names, ev.Name)
+		case <-time.After(time.Second):
+			t.Fatalf("expect 4 distinct events, got %v", names)
+		}
+	}
+	select {
+	case ev := <-all:
+		t.Errorf("duplicated event delivered %+v", ev)
+	case ev := <-coalesced:
+		if string(ev.Payload) != "v3" {
+			t.Errorf("coalesced event should be the latest, got %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("coalesced event is not delivered")
+	}
+
+	// older events of the same name are dropped after delivered
+	s.uevents.notifyMessage(encodeUserEvent(&UserEvent{Name: "deploy", From: "d", LTime: 2}))
+	select {
+	case ev := <-coalesced:
+		t.Errorf("stale event delivered %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestUserEventHandlerPanic(t *testing.T) {
+	var s = NewServer("a", "")
+	s.ctx = context.Simple()
+
+	var got = make(chan string, 2)
+	defer s.HandleEvent("", 0, func(ctx context.Context, ev *UserEvent) {
+		if ev.Name == "panic" {
+			panic("boom")
+		}
+		got <- ev.Name
+	})()
+	s.uevents.notifyMessage(encodeUserEvent(&UserEvent{Name: "panic", From: "b", LTime: 1}))
+	s.uevents.notifyMessage(encodeUserEvent(&UserEvent{Name: "next", From: "b", LTime: 2}))
+	select {
+	case name := <-got:
+		if name != "next" {
+			t.Errorf("unexpected event %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("events after the panic should be delivered")
+	}
+}
@@ -1,11 +1,57 @@
 package gossip
 
 import (
+	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/cjey/gbase/context"
 )
 
+// subscribers 订阅者列表，写时复制，dispatch取得快照后不持锁遍历，同时可能有订阅者被移除
+type subscribers struct {
+	mu   sync.RWMutex
+	list []interface{}
+}
+
+func (l *subscribers) add(sub interface{}) {
+	l.mu.Lock()
+	l.list = append(l.list, sub)
+	l.mu.Unlock()
+}
+
+func (l *subscribers) remove(sub interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, s := range l.list {
+		if s == sub {
+			var n = make([]interface{}, 0, len(l.list)-1)
+			n = append(n, l.list[:i]...)
+			l.list = append(n, l.list[i+1:]...)
+			return
+		}
+	}
+}
+
+func (l *subscribers) snapshot() []interface{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.list
+}
+
+// safeCall 执行用户注册的handler，panic记录日志后作为错误返回，不能让整个节点崩溃
+func safeCall(ctx context.Context, what string, fn func() error, kvs ...interface{}) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			ctx.Error(what+" handler panic", append(kvs, "panic", v)...)
+			err = fmt.Errorf("handler panic, %v", v)
+		}
+	}()
+	return fn()
+}
+
 func UniqTCPAddr(one string, all []string) (*net.TCPAddr, []*net.TCPAddr, error) {
 	var addr, err = net.ResolveTCPAddr("tcp", one)
 	if err != nil {